@@ -1,7 +1,10 @@
 package azure
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"time"
@@ -9,6 +12,7 @@ import (
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/spf13/cobra"
 	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
 )
 
 func getBlobMetadata() azblob.Metadata {
@@ -53,10 +57,11 @@ func UpsertContainer(containerName string) error {
 
 // InitBlob creates the blob containers if they do not exist
 func InitBlob() {
-	err := getCredential()
+	credential, err := getCredential()
 	if err != nil {
 		cobra.CheckErr(err)
 	}
+	azureCredential = credential
 
 	azurePipeline = azblob.NewPipeline(azureCredential, azblob.PipelineOptions{})
 
@@ -65,7 +70,11 @@ func InitBlob() {
 		cobra.CheckErr(err)
 	}
 	// Create public keys container
-	if err := UpsertContainer("publickeys"); err != nil {
+	if err := UpsertContainer(constant.PublicKeyContainerName); err != nil {
+		cobra.CheckErr(err)
+	}
+	// Create pending keys container for keys awaiting approval
+	if err := UpsertContainer(constant.PendingKeyContainerName); err != nil {
 		cobra.CheckErr(err)
 	}
 }
@@ -102,7 +111,9 @@ func DownloadBuffer(containerName string, blobName string) ([]byte, error) {
 	return bytes, nil
 }
 
-func UploadFromFile(containerName string, blobName string, fileName string, progress func(bytes int64)) (string, error) {
+// UploadFromFile uploads a file and returns a signed URL to download it.
+// Cancelling ctx stops the upload.
+func UploadFromFile(ctx context.Context, containerName string, blobName string, fileName string, progress func(bytes int64)) (string, error) {
 	blobURL := getBlobURL(containerName, blobName)
 	blockBlobURL := blobURL.ToBlockBlobURL()
 
@@ -111,7 +122,7 @@ func UploadFromFile(containerName string, blobName string, fileName string, prog
 		return "", err
 	}
 
-	_, err = azblob.UploadFileToBlockBlob(getContext(), file, blockBlobURL, azblob.UploadToBlockBlobOptions{
+	_, err = azblob.UploadFileToBlockBlob(ctx, file, blockBlobURL, azblob.UploadToBlockBlobOptions{
 		BlockSize: 32 * 1024,
 		Metadata:  getBlobMetadata(),
 		Progress:  progress,
@@ -125,40 +136,67 @@ func UploadFromFile(containerName string, blobName string, fileName string, prog
 
 	log.Debug(fmt.Sprintf("Uploaded %s to %s", fileName, blobURL))
 
-	sasQueryParams, err := azblob.BlobSASSignatureValues{
-		Protocol:      azblob.SASProtocolHTTPS,
-		ExpiryTime:    time.Now().UTC().Add(1 * time.Hour),
-		Permissions:   azblob.BlobSASPermissions{Read: true}.String(),
-		ContainerName: containerName,
-		BlobName:      blobName,
-	}.NewSASQueryParameters(azureCredential)
+	signedURL, err := signBlobURL(containerName, blobName, time.Hour)
 	if err != nil {
 		log.Trace(err)
 		log.Debug(fmt.Sprintf("Failed to generate SAS query params for %s/%s", containerName, blobName))
 		return "", err
 	}
 
-	signedURL := sasQueryParams.Encode()
+	log.Debug(fmt.Sprintf("Signed URL: %s", signedURL))
 
-	signedURL = fmt.Sprintf(
-		"https://%s.blob.core.windows.net/%s/%s?%s",
-		config.GetConfig().Azure.AccountName,
-		containerName,
-		blobName,
-		signedURL,
-	)
+	return signedURL, nil
+}
+
+// signBlobURL returns a read-only SAS URL for a blob. It is signed with the
+// account key when there is one, and otherwise with a user delegation key
+// obtained with the token credential of the agent.
+func signBlobURL(containerName string, blobName string, validFor time.Duration) (string, error) {
+	var signer azblob.StorageAccountCredential
+	now := time.Now().UTC()
+
+	switch credential := azureCredential.(type) {
+	case *azblob.SharedKeyCredential:
+		signer = credential
+	case azblob.TokenCredential:
+		serviceURL, _ := url.Parse(storageAccount.blobEndpoint)
+		service := azblob.NewServiceURL(*serviceURL, azurePipeline)
+
+		delegationCredential, err := service.GetUserDelegationCredential(getContext(), azblob.NewKeyInfo(now.Add(-5*time.Minute), now.Add(validFor)), nil, nil)
+		if err != nil {
+			return "", err
+		}
+		signer = delegationCredential
+	default:
+		return "", errors.New("a SAS credential cannot sign download URLs, use an account key or a token credential to send files")
+	}
 
+	protocol := azblob.SASProtocolHTTPS
+	blobURL := getBlobURL(containerName, blobName).URL()
+	if blobURL.Scheme == "http" {
+		// Only the storage emulator is served over plain HTTP
+		protocol = azblob.SASProtocolHTTPSandHTTP
+	}
+
+	sasQueryParams, err := azblob.BlobSASSignatureValues{
+		Protocol:      protocol,
+		StartTime:     now.Add(-5 * time.Minute),
+		ExpiryTime:    now.Add(validFor),
+		Permissions:   azblob.BlobSASPermissions{Read: true}.String(),
+		ContainerName: containerName,
+		BlobName:      blobName,
+	}.NewSASQueryParameters(signer)
 	if err != nil {
-		log.Trace(err)
 		return "", err
 	}
 
-	log.Debug(fmt.Sprintf("Signed URL: %s", signedURL))
-
-	return signedURL, nil
+	blobURL.RawQuery = sasQueryParams.Encode()
+	return blobURL.String(), nil
 }
 
-func DownloadSignedURLToFile(signedURL string, fileName string, progress func(bytes int64)) error {
+// DownloadSignedURLToFile downloads a blob to a file. Cancelling ctx stops
+// the download.
+func DownloadSignedURLToFile(ctx context.Context, signedURL string, fileName string, progress func(bytes int64)) error {
 	blobURLBase, _ := url.Parse(signedURL)
 	anonymousCredential := azblob.NewAnonymousCredential()
 	pipeline := azblob.NewPipeline(anonymousCredential, azblob.PipelineOptions{})
@@ -168,12 +206,12 @@ func DownloadSignedURLToFile(signedURL string, fileName string, progress func(by
 	if err != nil {
 		log.Trace(err)
 		log.Error(fmt.Sprintf("Failed to create file %s", fileName))
-		return nil
+		return err
 	}
 
 	defer file.Close()
 
-	err = azblob.DownloadBlobToFile(azureContext, blobURL, 0, 0, file, azblob.DownloadFromBlobOptions{
+	err = azblob.DownloadBlobToFile(ctx, blobURL, 0, 0, file, azblob.DownloadFromBlobOptions{
 		BlockSize: 32 * 1024,
 		Progress:  progress,
 	})
@@ -181,9 +219,94 @@ func DownloadSignedURLToFile(signedURL string, fileName string, progress func(by
 	if err != nil {
 		log.Trace(err)
 		log.Error(fmt.Sprintf("Failed to download %s", fileName))
-		return nil
+		return err
 	}
 
 	log.Debug(fmt.Sprintf("Downloaded %s to %s", signedURL, fileName))
 	return nil
 }
+
+// DownloadBufferWithETag downloads a blob and returns its ETag so that the
+// caller can perform an optimistic concurrency update with UploadBufferIfMatch
+func DownloadBufferWithETag(containerName string, blobName string) ([]byte, azblob.ETag, error) {
+	blobURL := getBlobURL(containerName, blobName)
+
+	properties, err := blobURL.GetProperties(getContext(), azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, azblob.ETagNone, err
+	}
+
+	bytes := make([]byte, properties.ContentLength())
+	err = azblob.DownloadBlobToBuffer(getContext(), blobURL, 0, 0, bytes, azblob.DownloadFromBlobOptions{
+		AccessConditions: azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: properties.ETag()},
+		},
+	})
+	if err != nil {
+		log.Trace(err)
+		return nil, azblob.ETagNone, err
+	}
+	return bytes, properties.ETag(), nil
+}
+
+// UploadBufferIfMatch uploads a blob only if it has not changed since it was
+// read. An empty ETag means the blob must not exist yet.
+func UploadBufferIfMatch(containerName string, blobName string, buffer []byte, etag azblob.ETag) error {
+	blockBlobURL := getBlobURL(containerName, blobName).ToBlockBlobURL()
+
+	conditions := azblob.ModifiedAccessConditions{IfMatch: etag}
+	if etag == azblob.ETagNone {
+		conditions = azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}
+	}
+
+	_, err := azblob.UploadBufferToBlockBlob(getContext(), buffer, blockBlobURL, azblob.UploadToBlockBlobOptions{
+		BlockSize:        2 * 1024,
+		Metadata:         getBlobMetadata(),
+		AccessConditions: azblob.BlobAccessConditions{ModifiedAccessConditions: conditions},
+	})
+	return err
+}
+
+// IsBlobNotFound reports whether err was caused by a missing blob
+func IsBlobNotFound(err error) bool {
+	if azErr, ok := err.(azblob.StorageError); ok {
+		return azErr.ServiceCode() == azblob.ServiceCodeBlobNotFound || azErr.Response().StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// IsConditionNotMet reports whether err was caused by a failed ETag condition
+func IsConditionNotMet(err error) bool {
+	if azErr, ok := err.(azblob.StorageError); ok {
+		return azErr.ServiceCode() == azblob.ServiceCodeConditionNotMet ||
+			azErr.ServiceCode() == azblob.ServiceCodeBlobAlreadyExists ||
+			azErr.Response().StatusCode == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+// DeleteBlob deletes a blob and its snapshots
+func DeleteBlob(containerName string, blobName string) error {
+	blobURL := getBlobURL(containerName, blobName)
+
+	_, err := blobURL.Delete(getContext(), azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	return err
+}
+
+// ListBlobs returns the names of the blobs in a container
+func ListBlobs(containerName string) ([]string, error) {
+	container := getContainer(containerName)
+	names := []string{}
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		response, err := container.ListBlobsFlatSegment(getContext(), marker, azblob.ListBlobsSegmentOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range response.Segment.BlobItems {
+			names = append(names, blob.Name)
+		}
+		marker = response.NextMarker
+	}
+	return names, nil
+}
@@ -0,0 +1,306 @@
+package azure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+const (
+	storageResource = "https://storage.azure.com/"
+
+	imdsTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+	defaultAuthorityHost = "https://login.microsoftonline.com/"
+
+	// tokenRefreshMargin renews tokens this long before they expire
+	tokenRefreshMargin = 5 * time.Minute
+
+	tokenRetryInterval = 30 * time.Second
+
+	// Well known account of the Azurite storage emulator
+	developmentAccountName = "devstoreaccount1"
+	developmentAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFr5Jw=="
+)
+
+// account describes how to reach and authenticate with the storage account
+type account struct {
+	name          string
+	key           string
+	sasToken      string
+	blobEndpoint  string
+	queueEndpoint string
+}
+
+var storageAccount account
+
+// parseConnectionString reads the account, key, SAS and endpoints from a
+// storage connection string, including 'UseDevelopmentStorage=true'
+func parseConnectionString(connectionString string) (account, error) {
+	settings := map[string]string{}
+	for _, setting := range strings.Split(connectionString, ";") {
+		if setting == "" {
+			continue
+		}
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return account{}, fmt.Errorf("connection string setting '%s' is not in the form key=value", parts[0])
+		}
+		settings[strings.ToLower(parts[0])] = parts[1]
+	}
+
+	if strings.EqualFold(settings["usedevelopmentstorage"], "true") {
+		return account{
+			name:          developmentAccountName,
+			key:           developmentAccountKey,
+			blobEndpoint:  "http://127.0.0.1:10000/" + developmentAccountName,
+			queueEndpoint: "http://127.0.0.1:10001/" + developmentAccountName,
+		}, nil
+	}
+
+	acc := account{
+		name:          settings["accountname"],
+		key:           settings["accountkey"],
+		sasToken:      strings.TrimPrefix(settings["sharedaccesssignature"], "?"),
+		blobEndpoint:  strings.TrimSuffix(settings["blobendpoint"], "/"),
+		queueEndpoint: strings.TrimSuffix(settings["queueendpoint"], "/"),
+	}
+
+	protocol := settings["defaultendpointsprotocol"]
+	if protocol == "" {
+		protocol = "https"
+	}
+	suffix := settings["endpointsuffix"]
+	if suffix == "" {
+		suffix = "core.windows.net"
+	}
+	if acc.blobEndpoint == "" && acc.name != "" {
+		acc.blobEndpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, acc.name, suffix)
+	}
+	if acc.queueEndpoint == "" && acc.name != "" {
+		acc.queueEndpoint = fmt.Sprintf("%s://%s.queue.%s", protocol, acc.name, suffix)
+	}
+
+	if acc.blobEndpoint == "" || acc.queueEndpoint == "" {
+		return account{}, errors.New("connection string names neither the account nor its blob and queue endpoints")
+	}
+	if acc.name == "" {
+		// Custom endpoints without an account name follow the Azurite layout of /<account>
+		endpoint, err := url.Parse(acc.blobEndpoint)
+		if err != nil {
+			return account{}, err
+		}
+		acc.name = strings.Trim(endpoint.Path, "/")
+	}
+	return acc, nil
+}
+
+// loadAccount works out the account and endpoints from the configuration
+func loadAccount() (account, error) {
+	cfg := config.GetConfig().Azure
+
+	if cfg.Credential == constant.AzureCredentialConnectionString {
+		return parseConnectionString(cfg.ConnectionString)
+	}
+
+	return account{
+		name:          cfg.AccountName,
+		key:           cfg.AccountKey,
+		sasToken:      strings.TrimPrefix(cfg.SASToken, "?"),
+		blobEndpoint:  fmt.Sprintf("https://%s.blob.core.windows.net", cfg.AccountName),
+		queueEndpoint: fmt.Sprintf("https://%s.queue.core.windows.net", cfg.AccountName),
+	}, nil
+}
+
+// sasTokenFor returns the SAS token for a container or queue. A token for the
+// specific resource, keyed by 'blob/<name>' or 'queue/<name>', takes
+// precedence over the account wide token.
+func sasTokenFor(resource string, name string) string {
+	if token, ok := config.GetConfig().Azure.SASTokens[resource+"/"+name]; ok {
+		return strings.TrimPrefix(token, "?")
+	}
+	return storageAccount.sasToken
+}
+
+// tokenResponse is returned by both the managed identity endpoints and Azure
+// AD. The managed identity endpoints encode expires_in as a string.
+type tokenResponse struct {
+	AccessToken string          `json:"access_token"`
+	ExpiresIn   json.RawMessage `json:"expires_in"`
+	Error       string          `json:"error"`
+	Description string          `json:"error_description"`
+}
+
+func readTokenResponse(response *http.Response) (string, time.Duration, error) {
+	defer response.Body.Close()
+
+	body := tokenResponse{}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return "", 0, err
+	}
+	if response.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", 0, fmt.Errorf("token request failed with status %d: %s %s", response.StatusCode, body.Error, body.Description)
+	}
+
+	expiresIn, err := strconv.Atoi(strings.Trim(string(body.ExpiresIn), `"`))
+	if err != nil {
+		return "", 0, fmt.Errorf("token has invalid expiry: %v", err)
+	}
+	return body.AccessToken, time.Duration(expiresIn) * time.Second, nil
+}
+
+// managedIdentityToken requests a storage token for the managed identity of
+// the host. App Service and Container Apps expose IDENTITY_ENDPOINT, other
+// hosts use the instance metadata service.
+func managedIdentityToken() (string, time.Duration, error) {
+	clientID := config.GetConfig().Azure.ClientID
+
+	var request *http.Request
+	var err error
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		query := url.Values{"api-version": {"2019-08-01"}, "resource": {storageResource}}
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		request, err = http.NewRequest(http.MethodGet, endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", 0, err
+		}
+		request.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	} else {
+		query := url.Values{"api-version": {"2018-02-01"}, "resource": {storageResource}}
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		request, err = http.NewRequest(http.MethodGet, imdsTokenURL+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", 0, err
+		}
+		request.Header.Set("Metadata", "true")
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", 0, err
+	}
+	return readTokenResponse(response)
+}
+
+// workloadIdentityToken exchanges the federated token projected into the pod
+// for a storage token. Settings default to the variables injected by the
+// workload identity webhook.
+func workloadIdentityToken() (string, time.Duration, error) {
+	cfg := config.GetConfig().Azure
+
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+	tenantID := cfg.TenantID
+	if tenantID == "" {
+		tenantID = os.Getenv("AZURE_TENANT_ID")
+	}
+	tokenFile := cfg.TokenFile
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	}
+	authorityHost := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authorityHost == "" {
+		authorityHost = defaultAuthorityHost
+	}
+	if clientID == "" || tenantID == "" || tokenFile == "" {
+		return "", 0, errors.New("workload identity needs a client ID, tenant ID and federated token file")
+	}
+
+	assertion, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", 0, err
+	}
+
+	form := url.Values{
+		"client_id":             {clientID},
+		"scope":                 {storageResource + ".default"},
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+	}
+	tokenURL := strings.TrimSuffix(authorityHost, "/") + "/" + tenantID + "/oauth2/v2.0/token"
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.PostForm(tokenURL, form)
+	if err != nil {
+		return "", 0, err
+	}
+	return readTokenResponse(response)
+}
+
+// refreshInterval renews a token shortly before it expires
+func refreshInterval(expiresIn time.Duration) time.Duration {
+	if expiresIn > 2*tokenRefreshMargin {
+		return expiresIn - tokenRefreshMargin
+	}
+	return expiresIn / 2
+}
+
+// newTokenCredential fetches a token and keeps it fresh in the background.
+// The first token is fetched up front so that configuration problems fail
+// startup rather than every request.
+func newTokenCredential(fetch func() (string, time.Duration, error)) (azblob.TokenCredential, error) {
+	token, expiresIn, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	// azblob calls the refresher immediately, which reuses the first token
+	fetched := true
+	return azblob.NewTokenCredential(token, func(credential azblob.TokenCredential) time.Duration {
+		if fetched {
+			fetched = false
+			return refreshInterval(expiresIn)
+		}
+
+		token, expiresIn, err := fetch()
+		if err != nil {
+			log.Error("Failed to refresh Azure access token", err)
+			return tokenRetryInterval
+		}
+		credential.SetToken(token)
+		return refreshInterval(expiresIn)
+	}), nil
+}
+
+// getCredential creates the credential for the configured mode
+func getCredential() (azblob.Credential, error) {
+	acc, err := loadAccount()
+	if err != nil {
+		return nil, err
+	}
+	storageAccount = acc
+
+	switch config.GetConfig().Azure.Credential {
+	case constant.AzureCredentialManagedIdentity:
+		return newTokenCredential(managedIdentityToken)
+	case constant.AzureCredentialWorkloadIdentity:
+		return newTokenCredential(workloadIdentityToken)
+	}
+
+	if acc.key != "" {
+		return azblob.NewSharedKeyCredential(acc.name, acc.key)
+	}
+	if acc.sasToken != "" || len(config.GetConfig().Azure.SASTokens) > 0 {
+		return azblob.NewAnonymousCredential(), nil
+	}
+	return nil, errors.New("no Azure credential is configured")
+}
@@ -7,36 +7,26 @@ import (
 
 	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
-	"github.com/willhackett/azure-mft/pkg/config"
 	"github.com/willhackett/azure-mft/pkg/logger"
 )
 
 var (
-	azureCredential *azblob.SharedKeyCredential
+	azureCredential azblob.Credential
 	azurePipeline   pipeline.Pipeline
 	azureContext    context.Context
 	log             = logger.Get()
 )
 
-func getCredential() error {
-	accountName, accountKey := config.GetConfig().Azure.AccountName, config.GetConfig().Azure.AccountKey
-
-	credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
-	if err != nil {
-		return err
-	}
-
-	azureCredential = credential
-
-	return nil
-}
-
+// getResourceURL returns the URL of a container or queue, carrying the SAS
+// token for it when one is configured
 func getResourceURL(name string, resource string) url.URL {
-	accountName := config.GetConfig().Azure.AccountName
+	endpoint := storageAccount.blobEndpoint
+	if resource == "queue" {
+		endpoint = storageAccount.queueEndpoint
+	}
 
-	URL, _ := url.Parse(
-		fmt.Sprintf("https://%s.%s.core.windows.net/%s", accountName, resource, name),
-	)
+	URL, _ := url.Parse(fmt.Sprintf("%s/%s", endpoint, name))
+	URL.RawQuery = sasTokenFor(resource, name)
 
 	return *URL
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/Azure/azure-storage-queue-go/azqueue"
 	"github.com/spf13/cobra"
 	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
 )
 
 func getQueueMetadata() azqueue.Metadata {
@@ -42,23 +43,71 @@ func UpsertQueue(queueName string) error {
 	return nil
 }
 
-// InitQueue is called by Cobra to setup the queue as needed
+// DeadLetterQueueName returns the queue holding the messages an agent could not process
+func DeadLetterQueueName(agentName string) string {
+	return agentName + constant.DeadLetterQueueSuffix
+}
+
+// PriorityQueueName returns the queue of an agent for a priority. Normal
+// priority uses the queue named after the agent.
+func PriorityQueueName(agentName string, priority string) string {
+	switch priority {
+	case constant.PriorityHigh:
+		return agentName + constant.HighPriorityQueueSuffix
+	case constant.PriorityBulk:
+		return agentName + constant.BulkPriorityQueueSuffix
+	}
+	return agentName
+}
+
+// InitQueue is called by Cobra to setup the queues as needed
 func InitQueue() {
-	if err := UpsertQueue(config.GetConfig().Agent.Name); err != nil {
+	agentName := config.GetConfig().Agent.Name
+
+	for _, priority := range constant.Priorities {
+		if err := UpsertQueue(PriorityQueueName(agentName, priority)); err != nil {
+			cobra.CheckErr(err)
+		}
+	}
+	if err := UpsertQueue(DeadLetterQueueName(agentName)); err != nil {
 		cobra.CheckErr(err)
 	}
 }
 
-func GetMessagesURLAndContext() (azqueue.MessagesURL, context.Context) {
-	messagesURL := getMessagesURL(config.GetConfig().Agent.Name)
+// GetMessagesURLAndContext returns the queue of the agent for a priority
+func GetMessagesURLAndContext(priority string) (azqueue.MessagesURL, context.Context) {
+	messagesURL := getMessagesURL(PriorityQueueName(config.GetConfig().Agent.Name, priority))
 
 	return messagesURL, azureContext
 }
 
-func PostMessage(queueName string, message string) error {
+func GetDeadLetterMessagesURLAndContext() (azqueue.MessagesURL, context.Context) {
+	messagesURL := getMessagesURL(DeadLetterQueueName(config.GetConfig().Agent.Name))
+
+	return messagesURL, getContext()
+}
+
+// CountDeadLetters returns the approximate number of messages on the
+// dead-letter queue of the agent
+func CountDeadLetters() (int, error) {
+	properties, err := getQueue(DeadLetterQueueName(config.GetConfig().Agent.Name)).GetProperties(getContext())
+	if err != nil {
+		return 0, err
+	}
+	return int(properties.ApproximateMessagesCount()), nil
+}
+
+// PostMessage enqueues a message that expires after ttl
+func PostMessage(queueName string, message string, ttl time.Duration) error {
+	return PostDelayedMessage(queueName, message, 0, ttl)
+}
+
+// PostDelayedMessage enqueues a message that stays hidden for delay and
+// expires after ttl
+func PostDelayedMessage(queueName string, message string, delay time.Duration, ttl time.Duration) error {
 	messagesURL := getMessagesURL(queueName)
 
-	_, err := messagesURL.Enqueue(getContext(), message, 0, 60*time.Minute)
+	_, err := messagesURL.Enqueue(getContext(), message, delay, ttl)
 
 	if err != nil {
 		return err
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/keys"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+var (
+	adminKeyFile string
+	// approveFingerprint is the fingerprint confirmed with the agent before approving its key
+	approveFingerprint string
+
+	// adminCmd groups the administrator commands
+	adminCmd = &cobra.Command{
+		Use:   "admin",
+		Short: "Administer agent enrollment",
+	}
+
+	// adminApproveCmd represents the admin approve command
+	adminApproveCmd = &cobra.Command{
+		Use:   "approve <agent> <keyID>",
+		Short: "Approve a pending agent key by countersigning it with the administrator key",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("Admin")
+			log := logger.Get()
+
+			if adminKeyFile == "" {
+				adminKeyFile = config.GetConfig().Enrollment.AdminKeyFile
+			}
+			if adminKeyFile == "" {
+				log.Fatal("The administrator key must be specified with --adminKey or config.enrollment.admin_key_file")
+				os.Exit(1)
+			}
+
+			// The pending key is only approved once its fingerprint is confirmed with the agent
+			if approveFingerprint == "" {
+				fingerprint, err := keys.PendingKeyFingerprint(args[0], args[1])
+				if err != nil {
+					log.Fatal("Cannot read pending key", err)
+					os.Exit(1)
+				}
+				fmt.Printf("Pending key '%s' of agent '%s' has fingerprint %s\n", args[1], args[0], fingerprint)
+				fmt.Println("Check it against 'azmft keys fingerprint' on the agent, then approve it with --fingerprint")
+				os.Exit(1)
+			}
+
+			fingerprint, err := keys.Approve(args[0], args[1], approveFingerprint, adminKeyFile)
+			if err != nil {
+				log.Fatal("Cannot approve key", err)
+				os.Exit(1)
+			}
+
+			log.Info(fmt.Sprintf("Approved key '%s' of agent '%s' with fingerprint %s", args[1], args[0], fingerprint))
+		},
+	}
+
+	// adminPendingCmd represents the admin pending command
+	adminPendingCmd = &cobra.Command{
+		Use:   "pending",
+		Short: "List agent keys awaiting approval",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("Admin")
+
+			pending, err := keys.ListPendingKeys()
+			if err != nil {
+				logger.Get().Fatal("Cannot list pending keys", err)
+				os.Exit(1)
+			}
+
+			for _, keyReference := range pending {
+				fmt.Println(keyReference)
+			}
+		},
+	}
+
+	// adminKeygenCmd represents the admin keygen command
+	adminKeygenCmd = &cobra.Command{
+		Use:   "keygen <file>",
+		Short: "Generate an administrator key and print its public key for agents to trust",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("Admin")
+
+			publicKey, err := keys.GenerateAdminKey(args[0])
+			if err != nil {
+				logger.Get().Fatal("Cannot generate administrator key", err)
+				os.Exit(1)
+			}
+
+			fmt.Print(string(publicKey))
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(adminCmd)
+
+	adminCmd.AddCommand(adminApproveCmd)
+	adminCmd.AddCommand(adminPendingCmd)
+	adminCmd.AddCommand(adminKeygenCmd)
+
+	adminApproveCmd.Flags().StringVar(&adminKeyFile, "adminKey", "", "Administrator private key (default is config.enrollment.admin_key_file)")
+	adminApproveCmd.Flags().StringVar(&approveFingerprint, "fingerprint", "", "Fingerprint of the key as reported by the agent")
+}
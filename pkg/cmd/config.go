@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/willhackett/azure-mft/pkg/config"
+)
+
+var (
+	// configCmd groups the configuration commands
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the agent configuration",
+	}
+
+	// configValidateCmd represents the config validate command
+	configValidateCmd = &cobra.Command{
+		Use:         "validate",
+		Short:       "Check the configuration file and report every problem with it",
+		Annotations: map[string]string{skipInitAnnotation: "true"},
+		Run: func(cmd *cobra.Command, args []string) {
+			errs, warnings := config.Validate()
+			for _, warning := range warnings {
+				fmt.Fprintln(os.Stderr, "warning:", warning)
+			}
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if len(errs) > 0 {
+				fmt.Fprintf(os.Stderr, "Configuration has %d problem(s)\n", len(errs))
+				os.Exit(1)
+			}
+
+			fmt.Println("Configuration is valid")
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+
+	configCmd.AddCommand(configValidateCmd)
+}
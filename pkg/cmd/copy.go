@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
 	"github.com/willhackett/azure-mft/pkg/logger"
 	"github.com/willhackett/azure-mft/pkg/tasks"
 )
@@ -15,6 +18,10 @@ var (
 	destinationAgent    string
 	destinationFileName string
 	fileName            string
+	priority            string
+	sourceAction        string
+	moveTo              string
+	renameSuffix        string
 
 	copyCmd = &cobra.Command{
 		Use:   "copy",
@@ -43,13 +50,33 @@ var (
 				os.Exit(1)
 			}
 
-			if err = tasks.SendFileRequest(fileName, config.GetConfig().Agent.Name, destinationAgent, destinationFileName); err != nil {
+			if !constant.StringInList(priority, constant.Priorities) {
+				log.Fatal(fmt.Sprintf("Priority must be one of %s", strings.Join(constant.Priorities, ", ")))
+				os.Exit(1)
+			}
+
+			if !constant.StringInList(sourceAction, constant.SourceActions) {
+				log.Fatal(fmt.Sprintf("Source action must be one of %s", strings.Join(constant.SourceActions, ", ")))
+				os.Exit(1)
+			}
+			if sourceAction == constant.SourceActionMove && !path.IsAbs(moveTo) {
+				log.Fatal("The move to directory must have an absolute path")
+				os.Exit(1)
+			}
+			if sourceAction == constant.SourceActionRename && renameSuffix == "" {
+				renameSuffix = constant.DefaultRenameSuffix
+			}
+
+			// The daemon of this agent acts on the file once the destination confirms delivery
+			action := constant.NewSourceAction(sourceAction, moveTo, renameSuffix)
+			transferID, err := tasks.SendFileRequest(fileName, config.GetConfig().Agent.Name, destinationAgent, destinationFileName, priority, action)
+			if err != nil {
 				log.Fatal("Cannot copy file")
 				log.Trace(err)
 				os.Exit(1)
 			}
 
-			log.Info("Done")
+			log.Info("Done, transfer ID " + transferID)
 		},
 	}
 )
@@ -60,4 +87,8 @@ func init() {
 	copyCmd.PersistentFlags().StringVar(&destinationAgent, "destinationAgent", "", "Destination agent")
 	copyCmd.PersistentFlags().StringVar(&destinationFileName, "destinationFileName", "", "Destination file name")
 	copyCmd.PersistentFlags().StringVar(&fileName, "fileName", "", "File name")
+	copyCmd.PersistentFlags().StringVar(&priority, "priority", constant.PriorityNormal, "Transfer priority: high, normal or bulk")
+	copyCmd.PersistentFlags().StringVar(&sourceAction, "sourceAction", constant.SourceActionKeep, "What to do with the file once delivered: keep, delete, move or rename")
+	copyCmd.PersistentFlags().StringVar(&moveTo, "moveTo", "", "Directory the file is moved to by the move source action")
+	copyCmd.PersistentFlags().StringVar(&renameSuffix, "renameSuffix", "", "Suffix added by the rename source action (default \".sent\")")
 }
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/willhackett/azure-mft/pkg/deadletter"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+var (
+	// dlqCmd groups the dead-letter queue commands
+	dlqCmd = &cobra.Command{
+		Use:   "dlq",
+		Short: "Review and replay messages that could not be processed",
+	}
+
+	// dlqListCmd represents the dlq list command
+	dlqListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the messages on the dead-letter queue",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("DeadLetter")
+
+			entries, count, err := deadletter.List()
+			if err != nil {
+				logger.Get().Fatal("Cannot read dead-letter queue", err)
+				os.Exit(1)
+			}
+
+			for _, entry := range entries {
+				fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", entry.ID, time.Unix(entry.FailedAt, 0).UTC().Format(time.RFC3339), entry.Agent, entry.Type, entry.Handler, entry.LastError)
+			}
+			if count > len(entries) {
+				fmt.Fprintf(os.Stderr, "showing the first %d of about %d dead letters, 'dlq show <id>' and 'dlq replay <id>' find any of them\n", len(entries), count)
+			}
+		},
+	}
+
+	// dlqShowCmd represents the dlq show command
+	dlqShowCmd = &cobra.Command{
+		Use:   "show <id>",
+		Short: "Show a message on the dead-letter queue with its failure",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("DeadLetter")
+			log := logger.Get()
+
+			entry, err := deadletter.Get(args[0])
+			if err != nil {
+				log.Fatal("Cannot read dead letter", err)
+				os.Exit(1)
+			}
+
+			out, err := json.MarshalIndent(entry, "", "  ")
+			if err != nil {
+				log.Fatal("Cannot format dead letter", err)
+				os.Exit(1)
+			}
+			fmt.Println(string(out))
+		},
+	}
+
+	// dlqReplayCmd represents the dlq replay command
+	dlqReplayCmd = &cobra.Command{
+		Use:   "replay <id>",
+		Short: "Put a message from the dead-letter queue back on the agent queue",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("DeadLetter")
+			log := logger.Get()
+
+			if err := deadletter.Replay(args[0]); err != nil {
+				log.Fatal("Cannot replay dead letter", err)
+				os.Exit(1)
+			}
+
+			log.Info(fmt.Sprintf("Replayed dead letter %s", args[0]))
+		},
+	}
+
+	// dlqPurgeCmd represents the dlq purge command
+	dlqPurgeCmd = &cobra.Command{
+		Use:   "purge",
+		Short: "Remove every message from the dead-letter queue",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("DeadLetter")
+			log := logger.Get()
+
+			if err := deadletter.Purge(); err != nil {
+				log.Fatal("Cannot purge dead-letter queue", err)
+				os.Exit(1)
+			}
+
+			log.Info("Purged dead-letter queue")
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(dlqCmd)
+
+	dlqCmd.AddCommand(dlqListCmd)
+	dlqCmd.AddCommand(dlqShowCmd)
+	dlqCmd.AddCommand(dlqReplayCmd)
+	dlqCmd.AddCommand(dlqPurgeCmd)
+}
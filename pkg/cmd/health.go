@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/health"
+)
+
+// healthCmd represents the health command
+var healthCmd = &cobra.Command{
+	Use:         "health",
+	Short:       "Report the health of the running service, exiting non-zero unless it is healthy",
+	Annotations: map[string]string{skipInitAnnotation: "true"},
+	Run: func(cmd *cobra.Command, args []string) {
+		// Only the configuration is needed, the check must not depend on Azure
+		config.Init()
+
+		status, err := health.Read()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot read health file:", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("status: %s since %s\n", status.Status, time.Unix(status.Since, 0).UTC().Format(time.RFC3339))
+		if status.ConsecutiveFailures > 0 {
+			fmt.Printf("consecutive failures: %d\n", status.ConsecutiveFailures)
+		}
+		if status.LastError != "" {
+			fmt.Printf("last error: %s\n", status.LastError)
+		}
+
+		if err := health.Check(status, time.Now()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(healthCmd)
+}
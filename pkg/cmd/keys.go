@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/willhackett/azure-mft/pkg/keys"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+var (
+	// keysCmd groups the key management commands
+	keysCmd = &cobra.Command{
+		Use:   "keys",
+		Short: "Manage agent keys",
+	}
+
+	// keysFingerprintCmd represents the keys fingerprint command
+	keysFingerprintCmd = &cobra.Command{
+		Use:   "fingerprint",
+		Short: "Print the key ID and fingerprint of this agent for pinning by peers",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("Keys")
+
+			provider := keys.GetProvider()
+			fingerprint, err := keys.Fingerprint(provider.PublicKey())
+			if err != nil {
+				logger.Get().Fatal("Cannot compute fingerprint", err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("%s\t%s\t%s\n", provider.KeyID(), provider.PublicKey().Algorithm, fingerprint)
+		},
+	}
+
+	csrOutputFile string
+
+	// keysCSRCmd represents the keys csr command
+	keysCSRCmd = &cobra.Command{
+		Use:   "csr",
+		Short: "Create a certificate signing request for the key of this agent",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("Keys")
+			log := logger.Get()
+
+			request, err := keys.CreateCertificateRequest()
+			if err != nil {
+				log.Fatal("Cannot create certificate signing request", err)
+				os.Exit(1)
+			}
+
+			if csrOutputFile == "" {
+				fmt.Print(string(request))
+				return
+			}
+
+			if err := ioutil.WriteFile(csrOutputFile, request, 0644); err != nil {
+				log.Fatal("Cannot write certificate signing request", err)
+				os.Exit(1)
+			}
+			log.Info(fmt.Sprintf("Wrote certificate signing request to %s", csrOutputFile))
+		},
+	}
+
+	// keysRevokeCmd represents the keys revoke command
+	keysRevokeCmd = &cobra.Command{
+		Use:   "revoke <agent> <keyID>",
+		Short: "Revoke the key of an agent so that peers no longer trust it",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("Keys")
+			log := logger.Get()
+
+			if err := keys.Revoke(args[0], args[1]); err != nil {
+				log.Fatal("Cannot revoke key", err)
+				os.Exit(1)
+			}
+
+			log.Info(fmt.Sprintf("Revoked key '%s' of agent '%s'", args[1], args[0]))
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+
+	keysCmd.AddCommand(keysCSRCmd)
+	keysCmd.AddCommand(keysFingerprintCmd)
+	keysCmd.AddCommand(keysRevokeCmd)
+
+	keysCSRCmd.Flags().StringVar(&csrOutputFile, "out", "", "File to write the request to (default is stdout)")
+}
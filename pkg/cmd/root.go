@@ -9,6 +9,12 @@ import (
 	"github.com/willhackett/azure-mft/pkg/logger"
 )
 
+const (
+	// skipInitAnnotation marks commands that run without loading the
+	// configuration or connecting to Azure
+	skipInitAnnotation = "azmft.skip_init"
+)
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "azmft",
@@ -16,6 +22,18 @@ var rootCmd = &cobra.Command{
 	Long: `Managed File Transfer between agents with Azure as a transport.
 
 For more information visit https://github.com/willhackett/azure-mft`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if _, ok := cmd.Annotations[skipInitAnnotation]; ok {
+			return
+		}
+
+		config.Init()
+		logger.Init()
+		azure.InitBlob()
+		azure.InitQueue()
+		keys.Init()
+		insights.Init()
+	},
 }
 
 func Execute() {
@@ -23,14 +41,5 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize(
-		config.Init,
-		logger.Init,
-		azure.InitBlob,
-		azure.InitQueue,
-		keys.Init,
-		insights.Init,
-	)
-
 	rootCmd.PersistentFlags().StringVar(&config.ConfigFilePath, "config", "", "config file location (default is ~/.config/azmft.config.yaml")
 }
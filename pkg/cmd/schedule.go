@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/schedule"
+)
+
+var (
+	historyLimit int
+
+	// scheduleCmd groups the schedule commands
+	scheduleCmd = &cobra.Command{
+		Use:   "schedule",
+		Short: "Review the recurring transfers of the schedules config section",
+	}
+
+	// scheduleListCmd represents the schedule list command
+	scheduleListCmd = &cobra.Command{
+		Use:         "list",
+		Short:       "List the schedules with their next and last runs",
+		Annotations: map[string]string{skipInitAnnotation: "true"},
+		Run: func(cmd *cobra.Command, args []string) {
+			// Schedules are read from the configuration and the local history
+			config.Init()
+
+			now := time.Now()
+			for _, entry := range config.GetConfig().Schedules {
+				next := "-"
+				if nextRun, err := schedule.NextRun(entry, now); err == nil {
+					next = nextRun.UTC().Format(time.RFC3339)
+				}
+
+				last := "-"
+				if runs, err := schedule.History(entry.Name, 1); err == nil && len(runs) > 0 {
+					last = fmt.Sprintf("%s %s", runs[0].ScheduledAt.UTC().Format(time.RFC3339), runs[0].Status)
+				}
+
+				fmt.Printf("%s\t%s\t%s\tnext %s\tlast %s\n", entry.Name, entry.Cron, entry.DestinationAgent, next, last)
+			}
+		},
+	}
+
+	// scheduleHistoryCmd represents the schedule history command
+	scheduleHistoryCmd = &cobra.Command{
+		Use:         "history [name]",
+		Short:       "Show the latest runs of every schedule or of one schedule",
+		Args:        cobra.MaximumNArgs(1),
+		Annotations: map[string]string{skipInitAnnotation: "true"},
+		Run: func(cmd *cobra.Command, args []string) {
+			config.Init()
+
+			name := ""
+			if len(args) > 0 {
+				name = args[0]
+			}
+
+			runs, err := schedule.History(name, historyLimit)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Cannot read schedule history:", err)
+				os.Exit(1)
+			}
+
+			for _, run := range runs {
+				detail := fmt.Sprintf("%d files", len(run.Files))
+				if run.CatchUp {
+					detail += fmt.Sprintf(", caught up %d missed runs", run.Missed)
+				} else if run.Missed > 0 {
+					detail += fmt.Sprintf(", missed %d runs", run.Missed)
+				}
+				if run.Error != "" {
+					detail += ", " + run.Error
+				}
+				fmt.Printf("%s\t%s\t%s\t%s\n", run.ScheduledAt.UTC().Format(time.RFC3339), run.Schedule, run.Status, detail)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(scheduleCmd)
+
+	scheduleCmd.AddCommand(scheduleListCmd)
+	scheduleCmd.AddCommand(scheduleHistoryCmd)
+
+	scheduleHistoryCmd.Flags().IntVarP(&historyLimit, "limit", "n", 20, "Number of runs to show")
+}
@@ -14,6 +14,7 @@ var startCmd = &cobra.Command{
 		logger.SetApp("Daemon")
 		logger.Get().Info("Agent started")
 		daemon.Init()
+		logger.Get().Info("Agent stopped")
 	},
 }
 
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/willhackett/azure-mft/pkg/keys"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+var (
+	// trustCmd groups the trust store commands
+	trustCmd = &cobra.Command{
+		Use:   "trust",
+		Short: "Manage the pinned keys of trusted agents",
+	}
+
+	// trustAddCmd represents the trust add command
+	trustAddCmd = &cobra.Command{
+		Use:   "add <agent> <fingerprint>",
+		Short: "Pin a key fingerprint for an agent",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("Trust")
+			log := logger.Get()
+
+			if err := keys.Trust(args[0], args[1]); err != nil {
+				log.Fatal("Cannot pin key", err)
+				os.Exit(1)
+			}
+
+			log.Info(fmt.Sprintf("Pinned key %s for agent '%s'", args[1], args[0]))
+		},
+	}
+
+	// trustRemoveCmd represents the trust remove command
+	trustRemoveCmd = &cobra.Command{
+		Use:   "remove <agent> <fingerprint>",
+		Short: "Remove a pinned key fingerprint of an agent",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("Trust")
+			log := logger.Get()
+
+			if err := keys.Untrust(args[0], args[1]); err != nil {
+				log.Fatal("Cannot remove pinned key", err)
+				os.Exit(1)
+			}
+
+			log.Info(fmt.Sprintf("Removed pinned key %s of agent '%s'", args[1], args[0]))
+		},
+	}
+
+	// trustListCmd represents the trust list command
+	trustListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the pinned keys of trusted agents",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.SetApp("Trust")
+
+			store, err := keys.GetTrustStore()
+			if err != nil {
+				logger.Get().Fatal("Cannot read trust store", err)
+				os.Exit(1)
+			}
+
+			agents := make([]string, 0, len(store.Agents))
+			for agent := range store.Agents {
+				agents = append(agents, agent)
+			}
+			sort.Strings(agents)
+
+			for _, agent := range agents {
+				for _, pin := range store.Agents[agent] {
+					fmt.Printf("%s\t%s\t%s\t%s\n", agent, pin.Fingerprint, pin.Source, time.Unix(pin.AddedAt, 0).UTC().Format(time.RFC3339))
+				}
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(trustCmd)
+
+	trustCmd.AddCommand(trustAddCmd)
+	trustCmd.AddCommand(trustRemoveCmd)
+	trustCmd.AddCommand(trustListCmd)
+}
@@ -1,13 +1,18 @@
 package config
 
 import (
-	"crypto/rsa"
-	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/willhackett/azure-mft/pkg/constant"
 )
 
 const (
@@ -15,38 +20,172 @@ const (
 )
 
 type AgentConf struct {
-	Name     string `mapstructure:"name"`
-	LogLevel string `mapstructure:"log_level"`
+	Name         string `mapstructure:"name"`
+	LogLevel     string `mapstructure:"log_level"`
+	KeyAlgorithm string `mapstructure:"key_algorithm"`
 }
 
 type PathsConf struct {
-	KeysDir  string `mapstructure:"keys_dir"`
-	CacheDir string `mapstructure:"cache_dir"`
-	TmpDir   string `mapstructure:"tmp_dir"`
+	KeysDir    string `mapstructure:"keys_dir"`
+	CacheDir   string `mapstructure:"cache_dir"`
+	TmpDir     string `mapstructure:"tmp_dir"`
+	TrustStore string `mapstructure:"trust_store"`
 }
 
 type AzureConf struct {
-	AccountName        string `mapstructure:"account_name"`
-	AccountKey         string `mapstructure:"account_key"`
-	InstrumentationKey string `mapstructure:"instrumentation_key"`
+	Credential         string            `mapstructure:"credential"`
+	AccountName        string            `mapstructure:"account_name"`
+	AccountKey         string            `mapstructure:"account_key" secret:"true"`
+	ConnectionString   string            `mapstructure:"connection_string" secret:"true"`
+	SASToken           string            `mapstructure:"sas_token" secret:"true"`
+	SASTokens          map[string]string `mapstructure:"sas_tokens" secret:"true"`
+	ClientID           string            `mapstructure:"client_id"`
+	TenantID           string            `mapstructure:"tenant_id"`
+	TokenFile          string            `mapstructure:"token_file"`
+	InstrumentationKey string            `mapstructure:"instrumentation_key" secret:"true"`
 }
 
+type KeysConf struct {
+	Provider             string `mapstructure:"provider"`
+	AgentSocket          string `mapstructure:"agent_socket"`
+	PassphraseEnv        string `mapstructure:"passphrase_env"`
+	PassphraseFile       string `mapstructure:"passphrase_file"`
+	PassphraseCredential string `mapstructure:"passphrase_credential"`
+}
+
+type PKIConf struct {
+	RootCAFile          string `mapstructure:"root_ca_file"`
+	CertificateFile     string `mapstructure:"certificate_file"`
+	RequireCertificates bool   `mapstructure:"require_certificates"`
+}
+
+type EnrollmentConf struct {
+	RequireApproval bool     `mapstructure:"require_approval"`
+	AdminPublicKeys []string `mapstructure:"admin_public_keys"`
+	AdminKeyFile    string   `mapstructure:"admin_key_file"`
+}
+
+type TrustConf struct {
+	Mode string `mapstructure:"mode"`
+}
+
+type PeerConf struct {
+	ReceiveRoots []string `mapstructure:"receive_roots"`
+	ServeRoots   []string `mapstructure:"serve_roots"`
+}
+
+type PolicyRule struct {
+	Peer        string   `mapstructure:"peer"`
+	Direction   string   `mapstructure:"direction"`
+	Paths       []string `mapstructure:"paths"`
+	Extensions  []string `mapstructure:"extensions"`
+	MaxFileSize int64    `mapstructure:"max_file_size"`
+	Windows     []string `mapstructure:"windows"`
+	DailyBytes  int64    `mapstructure:"daily_bytes"`
+	DailyFiles  int      `mapstructure:"daily_files"`
+}
+
+type PolicyConf struct {
+	Default     string       `mapstructure:"default"`
+	DecisionLog string       `mapstructure:"decision_log"`
+	Rules       []PolicyRule `mapstructure:"rules"`
+}
+
+type MessageTypeConf struct {
+	Workers        int           `mapstructure:"workers"`
+	MaxRetries     *int          `mapstructure:"max_retries"`
+	LeaseExtension time.Duration `mapstructure:"lease_extension"`
+	MessageTTL     time.Duration `mapstructure:"message_ttl"`
+}
+
+type DaemonConf struct {
+	Workers           int                        `mapstructure:"workers"`
+	ControlWorkers    int                        `mapstructure:"control_workers"`
+	DataBacklog       *int                       `mapstructure:"data_backlog"`
+	MaxRetries        *int                       `mapstructure:"max_retries"`
+	VisibilityTimeout time.Duration              `mapstructure:"visibility_timeout"`
+	LeaseExtension    time.Duration              `mapstructure:"lease_extension"`
+	MessageTTL        time.Duration              `mapstructure:"message_ttl"`
+	DrainTimeout      time.Duration              `mapstructure:"drain_timeout"`
+	PollIntervalMin   time.Duration              `mapstructure:"poll_interval_min"`
+	PollIntervalMax   time.Duration              `mapstructure:"poll_interval_max"`
+	BackoffMax        time.Duration              `mapstructure:"backoff_max"`
+	FailureThreshold  int                        `mapstructure:"failure_threshold"`
+	PriorityWeights   map[string]int             `mapstructure:"priority_weights"`
+	MessageTypes      map[string]MessageTypeConf `mapstructure:"message_types"`
+}
+
+// ForType returns the settings for a message type with the daemon wide
+// settings filled in where the type does not override them. Workers is only
+// set for types with a dedicated worker pool.
+func (d DaemonConf) ForType(messageType string) MessageTypeConf {
+	settings := d.MessageTypes[strings.ToLower(messageType)]
+
+	if settings.MaxRetries == nil {
+		settings.MaxRetries = d.MaxRetries
+	}
+	if settings.LeaseExtension == 0 {
+		settings.LeaseExtension = d.LeaseExtension
+	}
+	if settings.MessageTTL == 0 {
+		settings.MessageTTL = d.MessageTTL
+	}
+	return settings
+}
+
+// ScheduleConf is a recurring transfer run by the daemon. Every file matching
+// Source is sent to DestinationPath on DestinationAgent.
+type ScheduleConf struct {
+	Name             string `mapstructure:"name"`
+	Cron             string `mapstructure:"cron"`
+	Timezone         string `mapstructure:"timezone"`
+	Source           string `mapstructure:"source"`
+	DestinationAgent string `mapstructure:"destination_agent"`
+	DestinationPath  string `mapstructure:"destination_path"`
+	Priority         string `mapstructure:"priority"`
+	IfMissing        string `mapstructure:"if_missing"`
+	CatchUp          *bool  `mapstructure:"catch_up"`
+	SourceAction     string `mapstructure:"source_action"`
+	MoveTo           string `mapstructure:"move_to"`
+	RenameSuffix     string `mapstructure:"rename_suffix"`
+}
+
+// WatchConf is a hot folder watched by the daemon. Files dropped in
+// Directory are sent to DestinationPath on DestinationAgent once they are
+// complete, which is when they have not changed for StableFor or, when Marker
+// is set, when a marker file named after them appears.
+type WatchConf struct {
+	Name             string        `mapstructure:"name"`
+	Directory        string        `mapstructure:"directory"`
+	DestinationAgent string        `mapstructure:"destination_agent"`
+	DestinationPath  string        `mapstructure:"destination_path"`
+	Priority         string        `mapstructure:"priority"`
+	Include          []string      `mapstructure:"include"`
+	Exclude          []string      `mapstructure:"exclude"`
+	StableFor        time.Duration `mapstructure:"stable_for"`
+	Marker           string        `mapstructure:"marker"`
+	SourceAction     string        `mapstructure:"source_action"`
+	MoveTo           string        `mapstructure:"move_to"`
+	RenameSuffix     string        `mapstructure:"rename_suffix"`
+}
+
+// Exit is a command run at a point in the life of a transfer. It runs for
+// transfers with AgentName as the peer, on the side of Direction and with a
+// local file name matching FileMatch; any of them may be left out to match
+// every transfer.
 type Exit struct {
-	AgentName string `mapstructure:"agent_name"`
-	FileMatch string `mapstructure:"file_match"`
-	Command   string `mapstructure:"command"`
+	Event     string        `mapstructure:"event"`
+	AgentName string        `mapstructure:"agent_name"`
+	Direction string        `mapstructure:"direction"`
+	FileMatch string        `mapstructure:"file_match"`
+	Command   string        `mapstructure:"command"`
+	Timeout   time.Duration `mapstructure:"timeout"`
 }
 
 type AllowFilesFrom []string
 
 type AllowRequestsFrom []string
 
-type Keys struct {
-	KeyID      string
-	PublicKey  *rsa.PublicKey
-	PrivateKey *rsa.PrivateKey
-}
-
 type Config struct {
 	Agent AgentConf `mapstructure:"agent"`
 
@@ -54,11 +193,37 @@ type Config struct {
 
 	Azure AzureConf `mapstructure:"azure"`
 
+	Keys KeysConf `mapstructure:"keys"`
+
+	Trust TrustConf `mapstructure:"trust"`
+
+	PKI PKIConf `mapstructure:"pki"`
+
+	Enrollment EnrollmentConf `mapstructure:"enrollment"`
+
 	Exits []Exit `mapstructure:"exits"`
 
 	AllowFilesFrom AllowFilesFrom `mapstructure:"allow_files_from"`
 
 	AllowRequestsFrom AllowRequestsFrom `mapstructure:"allow_requests_from"`
+
+	RevocationAuthorities []string `mapstructure:"revocation_authorities"`
+
+	Peers map[string]PeerConf `mapstructure:"peers"`
+
+	Policy PolicyConf `mapstructure:"policy"`
+
+	Daemon DaemonConf `mapstructure:"daemon"`
+
+	Schedules []ScheduleConf `mapstructure:"schedules"`
+
+	Watches []WatchConf `mapstructure:"watches"`
+}
+
+// document is the layout of the configuration file
+type document struct {
+	Version int    `mapstructure:"version"`
+	Config  Config `mapstructure:"config"`
 }
 
 var (
@@ -66,19 +231,20 @@ var (
 
 	config Config
 
-	privateKey *rsa.PrivateKey
-
-	publicKey *rsa.PublicKey
-
-	keyID string
+	lock sync.RWMutex
 )
 
-func Init() {
+// readInConfig locates the configuration file and reads it into viper
+func readInConfig() error {
+	bindEnvs(reflect.TypeOf(Config{}), "config")
+
 	if ConfigFilePath != "" {
 		viper.SetConfigFile(ConfigFilePath)
 	} else {
 		userConfigDir, err := os.UserConfigDir()
-		cobra.CheckErr(err)
+		if err != nil {
+			return err
+		}
 
 		viper.AddConfigPath(userConfigDir)
 		viper.AddConfigPath("/var/azmft/")
@@ -88,57 +254,250 @@ func Init() {
 		viper.SetConfigName("azmft.config.yaml")
 	}
 
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Fprintln(os.Stderr, "Config loaded: ", viper.ConfigFileUsed())
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			return nil
+		}
+		return err
 	}
+	fmt.Fprintln(os.Stderr, "Config loaded: ", viper.ConfigFileUsed())
+	return nil
+}
+
+func Init() {
+	cobra.CheckErr(readInConfig())
 
-	if err := viper.UnmarshalKey("config", &config); err != nil {
-		cobra.CheckErr(err)
+	var err error
+	config, err = load()
+	cobra.CheckErr(err)
+}
+
+// Validate reads the configuration file and returns every problem with it,
+// along with warnings about settings that are valid but likely mistaken
+func Validate() ([]error, []string) {
+	if err := readInConfig(); err != nil {
+		return []error{err}, nil
 	}
 
-	if config.Agent.Name == "" {
-		cobra.CheckErr(errors.New("config.agent.name is not specified"))
+	cfg, err := load()
+	if errs, ok := err.(ValidationErrors); ok {
+		return errs, warnings(cfg)
 	}
-	if config.Agent.Name == "publickeys" {
-		cobra.CheckErr(errors.New("publickeys is a reserved agent name"))
+	if err != nil {
+		return []error{err}, nil
 	}
-	if config.Azure.AccountName == "" {
-		cobra.CheckErr(errors.New("config.azure.account_name is not specified"))
+	return nil, warnings(cfg)
+}
+
+// Warnings returns warnings about the running configuration
+func Warnings() []string {
+	return warnings(GetConfig())
+}
+
+// load reads the configuration from viper, applies defaults and validates
+// it. Problems are returned together as ValidationErrors.
+func load() (Config, error) {
+	errs := ValidationErrors{}
+
+	// Decode strictly first so that misspelt settings are reported alongside
+	// the other problems rather than silently ignored. The whole document is
+	// decoded since viper only merges environment overrides into it.
+	err := viper.Unmarshal(&document{}, func(decoderConfig *mapstructure.DecoderConfig) {
+		decoderConfig.ErrorUnused = true
+	})
+	if decodeErr, ok := err.(*mapstructure.Error); ok {
+		for _, message := range decodeErr.Errors {
+			errs = append(errs, decodeError(message))
+		}
 	}
-	if config.Azure.AccountKey == "" {
-		cobra.CheckErr(errors.New("config.azure.account_key is not specified"))
+
+	doc := document{}
+	if err := viper.Unmarshal(&doc); err != nil {
+		// The strict decode has reported the same problems already
+		if len(errs) > 0 {
+			return doc.Config, errs
+		}
+		return doc.Config, ValidationErrors{err}
 	}
+	cfg := doc.Config
+
+	errs = append(errs, resolveSecrets(reflect.ValueOf(&cfg).Elem(), "config")...)
+
+	if err := setDefaults(&cfg); err != nil {
+		return cfg, err
+	}
+
+	errs = append(errs, validate(cfg)...)
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+var unusedKeysPattern = regexp.MustCompile(`^'(.*)' has invalid keys: (.*)$`)
 
+// decodeError names the setting a decoding problem was found in
+func decodeError(message string) error {
+	match := unusedKeysPattern.FindStringSubmatch(message)
+	if match == nil {
+		return fmt.Errorf("config: %s", message)
+	}
+
+	setting := match[1]
+	if setting == "" {
+		setting = "configuration file"
+	}
+	return fmt.Errorf("%s has unknown settings: %s", setting, match[2])
+}
+
+func setDefaults(cfg *Config) error {
 	cacheDir, err := os.UserCacheDir()
-	cobra.CheckErr(err)
+	if err != nil {
+		return err
+	}
 	userHomeDir, err := os.UserHomeDir()
-	cobra.CheckErr(err)
+	if err != nil {
+		return err
+	}
 
-	if config.Paths.CacheDir == "" {
-		config.Paths.CacheDir = cacheDir + "/azmft"
+	if cfg.Agent.KeyAlgorithm == "" {
+		cfg.Agent.KeyAlgorithm = constant.KeyAlgorithmRSA
+	}
+	if cfg.Azure.Credential == "" {
+		cfg.Azure.Credential = constant.AzureCredentialSharedKey
+	}
+	if cfg.Paths.CacheDir == "" {
+		cfg.Paths.CacheDir = cacheDir + "/azmft"
+	}
+	if cfg.Paths.KeysDir == "" {
+		cfg.Paths.KeysDir = userHomeDir + "/azmft/keys"
 	}
-	if config.Paths.KeysDir == "" {
-		config.Paths.KeysDir = userHomeDir + "/azmft/keys"
+	if cfg.Paths.TmpDir == "" {
+		cfg.Paths.TmpDir = os.TempDir()
 	}
-	if config.Paths.TmpDir == "" {
-		config.Paths.TmpDir = os.TempDir()
+	if cfg.Paths.TrustStore == "" {
+		cfg.Paths.TrustStore = cfg.Paths.KeysDir + "/truststore.json"
 	}
+	if cfg.Trust.Mode == "" {
+		cfg.Trust.Mode = constant.TrustModeTOFU
+	}
+	if cfg.Keys.Provider == "" {
+		cfg.Keys.Provider = constant.KeyProviderFile
+	}
+	if cfg.Keys.PassphraseEnv == "" {
+		cfg.Keys.PassphraseEnv = "AZMFT_KEY_PASSPHRASE"
+	}
+	if cfg.Policy.Default == "" {
+		cfg.Policy.Default = constant.PolicyDefaultAllow
+	}
+	if cfg.Policy.DecisionLog == "" {
+		cfg.Policy.DecisionLog = cfg.Paths.CacheDir + "/decisions.log"
+	}
+	if cfg.Daemon.Workers == 0 {
+		cfg.Daemon.Workers = constant.DefaultWorkers
+	}
+	if cfg.Daemon.ControlWorkers == 0 {
+		cfg.Daemon.ControlWorkers = constant.DefaultControlWorkers
+	}
+	if cfg.Daemon.DataBacklog == nil {
+		dataBacklog := constant.DefaultDataBacklog
+		cfg.Daemon.DataBacklog = &dataBacklog
+	}
+	if cfg.Daemon.MaxRetries == nil {
+		maxRetries := constant.DefaultMaxRetries
+		cfg.Daemon.MaxRetries = &maxRetries
+	}
+	if cfg.Daemon.VisibilityTimeout == 0 {
+		cfg.Daemon.VisibilityTimeout = constant.DefaultVisibilityTimeout
+	}
+	if cfg.Daemon.LeaseExtension == 0 {
+		cfg.Daemon.LeaseExtension = constant.DefaultLeaseExtension
+	}
+	if cfg.Daemon.MessageTTL == 0 {
+		cfg.Daemon.MessageTTL = constant.DefaultMessageTTL
+	}
+	if cfg.Daemon.DrainTimeout == 0 {
+		cfg.Daemon.DrainTimeout = constant.DefaultDrainTimeout
+	}
+	if cfg.Daemon.PollIntervalMin == 0 {
+		cfg.Daemon.PollIntervalMin = constant.DefaultPollIntervalMin
+	}
+	if cfg.Daemon.PollIntervalMax == 0 {
+		cfg.Daemon.PollIntervalMax = constant.DefaultPollIntervalMax
+	}
+	if cfg.Daemon.BackoffMax == 0 {
+		cfg.Daemon.BackoffMax = constant.DefaultBackoffMax
+	}
+	if cfg.Daemon.FailureThreshold == 0 {
+		cfg.Daemon.FailureThreshold = constant.DefaultFailureThreshold
+	}
+	for i := range cfg.Schedules {
+		schedule := &cfg.Schedules[i]
+		if schedule.Priority == "" {
+			schedule.Priority = constant.PriorityNormal
+		}
+		if schedule.IfMissing == "" {
+			schedule.IfMissing = constant.ScheduleIfMissingWarn
+		}
+		if schedule.CatchUp == nil {
+			catchUp := true
+			schedule.CatchUp = &catchUp
+		}
+		if schedule.SourceAction == "" {
+			schedule.SourceAction = constant.SourceActionKeep
+		}
+		if schedule.SourceAction == constant.SourceActionRename && schedule.RenameSuffix == "" {
+			schedule.RenameSuffix = constant.DefaultRenameSuffix
+		}
+	}
+	for i := range cfg.Exits {
+		exit := &cfg.Exits[i]
+		// Exits ran after a file was received before they had events
+		if exit.Event == "" {
+			exit.Event = constant.ExitAfterReceive
+		}
+		if exit.Timeout == 0 {
+			exit.Timeout = constant.DefaultExitTimeout
+		}
+	}
+	for i := range cfg.Watches {
+		watch := &cfg.Watches[i]
+		if watch.Priority == "" {
+			watch.Priority = constant.PriorityNormal
+		}
+		if watch.StableFor == 0 {
+			watch.StableFor = constant.DefaultWatchStableFor
+		}
+		if watch.SourceAction == "" {
+			watch.SourceAction = constant.SourceActionKeep
+		}
+		if watch.SourceAction == constant.SourceActionRename && watch.RenameSuffix == "" {
+			watch.RenameSuffix = constant.DefaultRenameSuffix
+		}
+	}
+	priorityWeights := map[string]int{}
+	for priority, weight := range constant.DefaultPriorityWeights {
+		priorityWeights[priority] = weight
+	}
+	for priority, weight := range cfg.Daemon.PriorityWeights {
+		priorityWeights[priority] = weight
+	}
+	cfg.Daemon.PriorityWeights = priorityWeights
+	return nil
 }
 
 func GetConfig() Config {
+	lock.RLock()
+	defer lock.RUnlock()
+
 	return config
 }
 
-func GetKeys() Keys {
-	return Keys{
-		KeyID:      keyID,
-		PublicKey:  publicKey,
-		PrivateKey: privateKey,
-	}
-}
+// Set swaps in a configuration without reading or validating a file, such as
+// for tests. Subscribers to changes are not called.
+func Set(cfg Config) {
+	lock.Lock()
+	defer lock.Unlock()
 
-func SetKeys(privateKeyIn *rsa.PrivateKey, publicKeyIn *rsa.PublicKey, keyIDIn string) {
-	publicKey = publicKeyIn
-	privateKey = privateKeyIn
-	keyID = keyIDIn
+	config = cfg
 }
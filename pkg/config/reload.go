@@ -0,0 +1,95 @@
+package config
+
+import (
+	"reflect"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// ChangeHandler is called with the new configuration after it was swapped in
+type ChangeHandler func(cfg Config)
+
+var handlers []ChangeHandler
+
+// OnChange registers a handler for configuration reloads
+func OnChange(handler ChangeHandler) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	handlers = append(handlers, handler)
+}
+
+// keepRestartSettings copies the settings that are only read at startup
+// from the running configuration and returns the names of those that changed
+func keepRestartSettings(running Config, cfg *Config) []string {
+	restart := []string{}
+
+	settings := []struct {
+		name    string
+		running interface{}
+		next    interface{}
+	}{
+		{"config.agent.name", &running.Agent.Name, &cfg.Agent.Name},
+		{"config.agent.key_algorithm", &running.Agent.KeyAlgorithm, &cfg.Agent.KeyAlgorithm},
+		{"config.paths", &running.Paths, &cfg.Paths},
+		{"config.azure", &running.Azure, &cfg.Azure},
+		{"config.keys", &running.Keys, &cfg.Keys},
+		{"config.pki.certificate_file", &running.PKI.CertificateFile, &cfg.PKI.CertificateFile},
+		{"config.enrollment.require_approval", &running.Enrollment.RequireApproval, &cfg.Enrollment.RequireApproval},
+		{"config.daemon.workers", &running.Daemon.Workers, &cfg.Daemon.Workers},
+		{"config.daemon.control_workers", &running.Daemon.ControlWorkers, &cfg.Daemon.ControlWorkers},
+		{"config.daemon.data_backlog", &running.Daemon.DataBacklog, &cfg.Daemon.DataBacklog},
+	}
+	for _, setting := range settings {
+		runningValue := reflect.ValueOf(setting.running).Elem()
+		nextValue := reflect.ValueOf(setting.next).Elem()
+		if !reflect.DeepEqual(runningValue.Interface(), nextValue.Interface()) {
+			restart = append(restart, setting.name)
+			nextValue.Set(runningValue)
+		}
+	}
+
+	// Worker pools are sized at startup, the other message type settings apply straight away
+	for messageType, settings := range cfg.Daemon.MessageTypes {
+		if running.Daemon.MessageTypes[messageType].Workers != settings.Workers {
+			restart = append(restart, "config.daemon.message_types."+messageType+".workers")
+		}
+	}
+	for messageType, settings := range running.Daemon.MessageTypes {
+		if _, ok := cfg.Daemon.MessageTypes[messageType]; !ok && settings.Workers > 0 {
+			restart = append(restart, "config.daemon.message_types."+messageType+".workers")
+		}
+	}
+	return restart
+}
+
+// Reload validates the configuration read by viper and swaps it in. Settings
+// that need a restart keep their running values and are returned by name.
+// An invalid configuration is rejected and the running one is kept.
+func Reload() ([]string, error) {
+	cfg, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	lock.Lock()
+	restart := keepRestartSettings(config, &cfg)
+	config = cfg
+	subscribers := append([]ChangeHandler{}, handlers...)
+	lock.Unlock()
+
+	for _, handler := range subscribers {
+		handler(cfg)
+	}
+	return restart, nil
+}
+
+// Watch reloads the configuration whenever the file changes and reports the
+// outcome of every reload
+func Watch(report func(restart []string, err error)) {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		report(Reload())
+	})
+	viper.WatchConfig()
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	envPrefix = "AZMFT"
+)
+
+// SecretResolver returns the secret a reference points to. The reference is
+// the part of the setting after the scheme, as in 'env:<reference>'.
+type SecretResolver func(reference string) (string, error)
+
+var (
+	secretResolvers = map[string]SecretResolver{
+		"env":  resolveEnvSecret,
+		"file": resolveFileSecret,
+	}
+
+	secretResolversLock sync.RWMutex
+)
+
+// RegisterSecretResolver adds a resolver for settings of the form
+// '<scheme>:<reference>', such as one backed by a secrets manager
+func RegisterSecretResolver(scheme string, resolver SecretResolver) {
+	secretResolversLock.Lock()
+	defer secretResolversLock.Unlock()
+
+	secretResolvers[scheme] = resolver
+}
+
+func resolveEnvSecret(reference string) (string, error) {
+	value, ok := os.LookupEnv(reference)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", reference)
+	}
+	return value, nil
+}
+
+func resolveFileSecret(reference string) (string, error) {
+	value, err := ioutil.ReadFile(reference)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(value), "\r\n"), nil
+}
+
+// resolveSecret replaces a reference with the secret it points to. Values
+// without a registered scheme are returned as they are.
+func resolveSecret(value string) (string, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return value, nil
+	}
+
+	secretResolversLock.RLock()
+	resolver, ok := secretResolvers[parts[0]]
+	secretResolversLock.RUnlock()
+	if !ok {
+		return value, nil
+	}
+	return resolver(parts[1])
+}
+
+// resolveSecrets resolves the references in every field tagged secret:"true"
+func resolveSecrets(value reflect.Value, setting string) ValidationErrors {
+	errs := ValidationErrors{}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		fieldValue := value.Field(i)
+		name := setting + "." + field.Tag.Get("mapstructure")
+
+		if field.Type.Kind() == reflect.Struct {
+			errs = append(errs, resolveSecrets(fieldValue, name)...)
+			continue
+		}
+		if field.Tag.Get("secret") != "true" {
+			continue
+		}
+
+		switch field.Type.Kind() {
+		case reflect.String:
+			secret, err := resolveSecret(fieldValue.String())
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+				continue
+			}
+			fieldValue.SetString(secret)
+		case reflect.Map:
+			resolved := reflect.MakeMap(field.Type)
+			for _, key := range fieldValue.MapKeys() {
+				secret, err := resolveSecret(fieldValue.MapIndex(key).String())
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s.%s: %v", name, key.String(), err))
+					continue
+				}
+				resolved.SetMapIndex(key, reflect.ValueOf(secret))
+			}
+			fieldValue.Set(resolved)
+		}
+	}
+	return errs
+}
+
+// bindEnvs binds every plain setting to an AZMFT_ environment variable named
+// after its path below config, such as AZMFT_AZURE_ACCOUNT_KEY for
+// config.azure.account_key. Lists are comma separated. Lists of objects and
+// maps can only be set in the file.
+func bindEnvs(t reflect.Type, key string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldKey := key + "." + field.Tag.Get("mapstructure")
+
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			bindEnvs(field.Type, fieldKey)
+		case reflect.Map:
+			continue
+		case reflect.Slice:
+			if field.Type.Elem().Kind() != reflect.String {
+				continue
+			}
+			fallthrough
+		default:
+			envName := envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(fieldKey, "config."), ".", "_"))
+			viper.BindEnv(fieldKey, envName)
+		}
+	}
+}
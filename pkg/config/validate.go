@@ -0,0 +1,475 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+// ValidationErrors holds every problem found in a configuration
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
+// agentNamePattern matches names that are valid as both queue and container
+// names: lowercase letters, digits and single hyphens between them
+var agentNamePattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// maxAgentNameLength leaves room for the suffix of the dead-letter queue
+// within the 63 characters allowed for queue names
+var maxAgentNameLength = 63 - len(constant.DeadLetterQueueSuffix)
+
+func validAgentName(agentName string) error {
+	if len(agentName) < 3 || len(agentName) > maxAgentNameLength {
+		return fmt.Errorf("agent name '%s' must be between 3 and %d characters long", agentName, maxAgentNameLength)
+	}
+	if !agentNamePattern.MatchString(agentName) {
+		return fmt.Errorf("agent name '%s' may only contain lowercase letters, digits and single hyphens between them", agentName)
+	}
+	if agentName == constant.PublicKeyContainerName || agentName == constant.PendingKeyContainerName {
+		return fmt.Errorf("%s is a reserved agent name", agentName)
+	}
+	return nil
+}
+
+// dirCreatable checks that dir is a directory or that its nearest existing
+// ancestor is, so that it can be created when needed
+func dirCreatable(dir string) error {
+	for path := filepath.Clean(dir); ; path = filepath.Dir(path) {
+		info, err := os.Stat(path)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", path)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if filepath.Dir(path) == path {
+			return fmt.Errorf("%s cannot be created", dir)
+		}
+	}
+}
+
+func fileExists(fileName string) error {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", fileName)
+	}
+	return nil
+}
+
+// warnings returns problems with a configuration that do not stop it from
+// being used
+func warnings(cfg Config) []string {
+	warnings := []string{}
+
+	// Without a peers section paths are not sandboxed, as before it existed
+	if len(cfg.Peers) == 0 {
+		warnings = append(warnings, "config.peers is not set, so paths are not sandboxed and peers may read and write any file this agent can; add peers entries with receive_roots and serve_roots")
+		return warnings
+	}
+
+	// File requests of the agent itself, from copy, schedules and watches, are
+	// read from the serve roots that apply to it
+	self, ok := cfg.Peers[strings.ToLower(cfg.Agent.Name)]
+	if !ok {
+		self = cfg.Peers["*"]
+	}
+	if len(self.ServeRoots) == 0 {
+		warnings = append(warnings, fmt.Sprintf("config.peers: no serve_roots apply to agent '%s' itself, so files it is asked to send by azmft copy, schedules and watches are rejected as NOT_ALLOWED; add a peers entry for '%s' or '*'", cfg.Agent.Name, cfg.Agent.Name))
+	}
+	return warnings
+}
+
+// validate checks a configuration with defaults applied and returns every
+// problem found
+func validate(cfg Config) ValidationErrors {
+	errs := ValidationErrors{}
+	check := func(setting string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", setting, err))
+		}
+	}
+
+	if cfg.Agent.Name == "" {
+		errs = append(errs, errors.New("config.agent.name is not specified"))
+	} else {
+		check("config.agent.name", validAgentName(cfg.Agent.Name))
+	}
+	if !constant.StringInList(cfg.Agent.KeyAlgorithm, constant.KeyAlgorithms) {
+		errs = append(errs, fmt.Errorf("config.agent.key_algorithm '%s' is not supported", cfg.Agent.KeyAlgorithm))
+	}
+	switch cfg.Azure.Credential {
+	case constant.AzureCredentialConnectionString:
+		if cfg.Azure.ConnectionString == "" {
+			errs = append(errs, errors.New("config.azure.connection_string is not specified"))
+		}
+	case constant.AzureCredentialSharedKey:
+		if cfg.Azure.AccountKey == "" {
+			errs = append(errs, errors.New("config.azure.account_key is not specified"))
+		}
+	case constant.AzureCredentialSAS:
+		if cfg.Azure.SASToken == "" && len(cfg.Azure.SASTokens) == 0 {
+			errs = append(errs, errors.New("config.azure.sas_token or config.azure.sas_tokens is required with the sas credential"))
+		}
+	case constant.AzureCredentialManagedIdentity, constant.AzureCredentialWorkloadIdentity:
+	default:
+		errs = append(errs, fmt.Errorf("config.azure.credential '%s' is not supported", cfg.Azure.Credential))
+	}
+	if cfg.Azure.Credential != constant.AzureCredentialConnectionString && cfg.Azure.AccountName == "" {
+		errs = append(errs, errors.New("config.azure.account_name is not specified"))
+	}
+	if cfg.Azure.TokenFile != "" {
+		check("config.azure.token_file", fileExists(cfg.Azure.TokenFile))
+	}
+
+	check("config.paths.keys_dir", dirCreatable(cfg.Paths.KeysDir))
+	check("config.paths.cache_dir", dirCreatable(cfg.Paths.CacheDir))
+	check("config.paths.tmp_dir", dirCreatable(cfg.Paths.TmpDir))
+	check("config.paths.trust_store", dirCreatable(filepath.Dir(cfg.Paths.TrustStore)))
+
+	if cfg.Trust.Mode != constant.TrustModeTOFU && cfg.Trust.Mode != constant.TrustModeExplicit {
+		errs = append(errs, fmt.Errorf("config.trust.mode '%s' is not supported", cfg.Trust.Mode))
+	}
+
+	if cfg.Keys.Provider != constant.KeyProviderFile && cfg.Keys.Provider != constant.KeyProviderAgent {
+		errs = append(errs, fmt.Errorf("config.keys.provider '%s' is not supported", cfg.Keys.Provider))
+	}
+	if cfg.Keys.Provider == constant.KeyProviderAgent && cfg.Keys.AgentSocket == "" {
+		errs = append(errs, errors.New("config.keys.agent_socket is not specified"))
+	}
+	if cfg.Keys.PassphraseFile != "" {
+		check("config.keys.passphrase_file", fileExists(cfg.Keys.PassphraseFile))
+	}
+
+	if cfg.PKI.RequireCertificates && cfg.PKI.RootCAFile == "" {
+		errs = append(errs, errors.New("config.pki.root_ca_file is required when certificates are required"))
+	}
+	if cfg.PKI.RootCAFile != "" {
+		check("config.pki.root_ca_file", fileExists(cfg.PKI.RootCAFile))
+	}
+	if cfg.PKI.CertificateFile != "" {
+		check("config.pki.certificate_file", fileExists(cfg.PKI.CertificateFile))
+	}
+
+	if cfg.Enrollment.RequireApproval && len(cfg.Enrollment.AdminPublicKeys) == 0 {
+		errs = append(errs, errors.New("config.enrollment.admin_public_keys is required when approval is required"))
+	}
+	for i, fileName := range cfg.Enrollment.AdminPublicKeys {
+		check(fmt.Sprintf("config.enrollment.admin_public_keys[%d]", i), fileExists(fileName))
+	}
+	if cfg.Enrollment.AdminKeyFile != "" {
+		check("config.enrollment.admin_key_file", fileExists(cfg.Enrollment.AdminKeyFile))
+	}
+
+	for i, agentName := range cfg.AllowFilesFrom {
+		check(fmt.Sprintf("config.allow_files_from[%d]", i), validAgentName(agentName))
+	}
+	for i, agentName := range cfg.AllowRequestsFrom {
+		check(fmt.Sprintf("config.allow_requests_from[%d]", i), validAgentName(agentName))
+	}
+	for i, agentName := range cfg.RevocationAuthorities {
+		check(fmt.Sprintf("config.revocation_authorities[%d]", i), validAgentName(agentName))
+	}
+
+	for i, exit := range cfg.Exits {
+		if exit.AgentName != "" {
+			check(fmt.Sprintf("config.exits[%d].agent_name", i), validAgentName(exit.AgentName))
+		}
+		if _, err := regexp.Compile(exit.FileMatch); err != nil {
+			errs = append(errs, fmt.Errorf("config.exits[%d].file_match: %v", i, err))
+		}
+		if exit.Command == "" {
+			errs = append(errs, fmt.Errorf("config.exits[%d].command is not specified", i))
+		} else if _, err := constant.SplitCommand(exit.Command); err != nil {
+			errs = append(errs, fmt.Errorf("config.exits[%d].command: %v", i, err))
+		}
+		if !constant.StringInList(exit.Event, constant.ExitEvents) {
+			errs = append(errs, fmt.Errorf("config.exits[%d].event '%s' is not supported, expected one of %s", i, exit.Event, strings.Join(constant.ExitEvents, ", ")))
+		}
+		if exit.Direction != "" && exit.Direction != constant.DirectionSend && exit.Direction != constant.DirectionReceive {
+			errs = append(errs, fmt.Errorf("config.exits[%d].direction '%s' is not supported", i, exit.Direction))
+		}
+		if exit.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("config.exits[%d].timeout must not be negative", i))
+		}
+	}
+
+	for agentName, peer := range cfg.Peers {
+		if agentName != "*" {
+			check(fmt.Sprintf("config.peers.%s", agentName), validAgentName(agentName))
+		}
+		for _, root := range append(peer.ReceiveRoots, peer.ServeRoots...) {
+			if !filepath.IsAbs(root) {
+				errs = append(errs, fmt.Errorf("config.peers.%s root '%s' is not an absolute path", agentName, root))
+			}
+		}
+	}
+
+	if cfg.Policy.Default != constant.PolicyDefaultAllow && cfg.Policy.Default != constant.PolicyDefaultDeny {
+		errs = append(errs, fmt.Errorf("config.policy.default '%s' is not supported", cfg.Policy.Default))
+	}
+	check("config.policy.decision_log", dirCreatable(filepath.Dir(cfg.Policy.DecisionLog)))
+	for i, rule := range cfg.Policy.Rules {
+		if rule.Peer == "" {
+			errs = append(errs, fmt.Errorf("config.policy.rules[%d].peer is not specified", i))
+		} else if rule.Peer != "*" {
+			check(fmt.Sprintf("config.policy.rules[%d].peer", i), validAgentName(rule.Peer))
+		}
+		if rule.Direction != constant.PolicyDirectionReceive && rule.Direction != constant.PolicyDirectionServe {
+			errs = append(errs, fmt.Errorf("config.policy.rules[%d].direction '%s' is not supported", i, rule.Direction))
+		}
+		for _, window := range rule.Windows {
+			if _, _, err := constant.ParseTimeWindow(window); err != nil {
+				errs = append(errs, fmt.Errorf("config.policy.rules[%d].windows: %v", i, err))
+			}
+		}
+	}
+
+	errs = append(errs, validateDaemon(cfg.Daemon)...)
+	errs = append(errs, validateSchedules(cfg.Schedules)...)
+	errs = append(errs, validateWatches(cfg.Watches)...)
+
+	return errs
+}
+
+func validateDaemon(daemon DaemonConf) ValidationErrors {
+	errs := ValidationErrors{}
+
+	if daemon.Workers < 1 {
+		errs = append(errs, fmt.Errorf("config.daemon.workers must be at least 1"))
+	}
+	if daemon.ControlWorkers < 1 {
+		errs = append(errs, fmt.Errorf("config.daemon.control_workers must be at least 1"))
+	}
+	if *daemon.DataBacklog < 0 {
+		errs = append(errs, fmt.Errorf("config.daemon.data_backlog must not be negative"))
+	}
+	if *daemon.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("config.daemon.max_retries must not be negative"))
+	}
+	if daemon.VisibilityTimeout < time.Second || daemon.VisibilityTimeout > constant.MaxVisibilityTimeout {
+		errs = append(errs, fmt.Errorf("config.daemon.visibility_timeout must be between 1s and %s", constant.MaxVisibilityTimeout))
+	}
+	if daemon.LeaseExtension < time.Second || daemon.LeaseExtension > constant.MaxVisibilityTimeout {
+		errs = append(errs, fmt.Errorf("config.daemon.lease_extension must be between 1s and %s", constant.MaxVisibilityTimeout))
+	}
+	if daemon.MessageTTL < time.Second {
+		errs = append(errs, fmt.Errorf("config.daemon.message_ttl must be at least 1s"))
+	}
+	if daemon.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("config.daemon.drain_timeout must not be negative"))
+	}
+	if daemon.PollIntervalMin < 0 {
+		errs = append(errs, fmt.Errorf("config.daemon.poll_interval_min must not be negative"))
+	}
+	if daemon.PollIntervalMax < daemon.PollIntervalMin {
+		errs = append(errs, fmt.Errorf("config.daemon.poll_interval_max must not be less than config.daemon.poll_interval_min"))
+	}
+	if daemon.BackoffMax < constant.BackoffBase {
+		errs = append(errs, fmt.Errorf("config.daemon.backoff_max must be at least %s", constant.BackoffBase))
+	}
+	if daemon.FailureThreshold < 1 {
+		errs = append(errs, fmt.Errorf("config.daemon.failure_threshold must be at least 1"))
+	}
+	for priority, weight := range daemon.PriorityWeights {
+		if !constant.StringInList(priority, constant.Priorities) {
+			errs = append(errs, fmt.Errorf("config.daemon.priority_weights.%s is not a priority, expected one of %s", priority, strings.Join(constant.Priorities, ", ")))
+		}
+		if weight < 1 {
+			errs = append(errs, fmt.Errorf("config.daemon.priority_weights.%s must be at least 1", priority))
+		}
+	}
+
+	knownTypes := []string{}
+	for _, messageType := range constant.MessageTypes {
+		knownTypes = append(knownTypes, strings.ToLower(messageType))
+	}
+	for messageType, settings := range daemon.MessageTypes {
+		setting := "config.daemon.message_types." + messageType
+		if !constant.StringInList(messageType, knownTypes) {
+			errs = append(errs, fmt.Errorf("%s is not a message type, expected one of %s", setting, strings.Join(constant.MessageTypes, ", ")))
+		}
+		if settings.Workers < 0 {
+			errs = append(errs, fmt.Errorf("%s.workers must not be negative", setting))
+		}
+		if settings.MaxRetries != nil && *settings.MaxRetries < 0 {
+			errs = append(errs, fmt.Errorf("%s.max_retries must not be negative", setting))
+		}
+		if settings.LeaseExtension < 0 || settings.LeaseExtension > constant.MaxVisibilityTimeout {
+			errs = append(errs, fmt.Errorf("%s.lease_extension must be between 1s and %s", setting, constant.MaxVisibilityTimeout))
+		}
+		if settings.MessageTTL < 0 {
+			errs = append(errs, fmt.Errorf("%s.message_ttl must not be negative", setting))
+		}
+	}
+	return errs
+}
+
+// ParseSchedule parses the cron expression of a schedule in its timezone.
+// Expressions have five fields or are a descriptor such as @daily.
+func ParseSchedule(schedule ScheduleConf) (cron.Schedule, error) {
+	spec := schedule.Cron
+	if schedule.Timezone != "" {
+		spec = "CRON_TZ=" + schedule.Timezone + " " + spec
+	}
+	return cron.ParseStandard(spec)
+}
+
+func validateSchedules(schedules []ScheduleConf) ValidationErrors {
+	errs := ValidationErrors{}
+	names := map[string]bool{}
+
+	for i, schedule := range schedules {
+		setting := fmt.Sprintf("config.schedules[%d]", i)
+
+		if schedule.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name is not specified", setting))
+		} else if names[schedule.Name] {
+			errs = append(errs, fmt.Errorf("%s.name '%s' is used by another schedule", setting, schedule.Name))
+		}
+		names[schedule.Name] = true
+
+		if schedule.Cron == "" {
+			errs = append(errs, fmt.Errorf("%s.cron is not specified", setting))
+		} else if _, err := ParseSchedule(schedule); err != nil {
+			errs = append(errs, fmt.Errorf("%s.cron: %v", setting, err))
+		}
+		if schedule.Timezone != "" {
+			if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+				errs = append(errs, fmt.Errorf("%s.timezone: %v", setting, err))
+			}
+		}
+
+		if !filepath.IsAbs(schedule.Source) {
+			errs = append(errs, fmt.Errorf("%s.source '%s' is not an absolute path", setting, schedule.Source))
+		} else if _, err := filepath.Match(schedule.Source, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s.source: %v", setting, err))
+		}
+
+		if schedule.DestinationAgent == "" {
+			errs = append(errs, fmt.Errorf("%s.destination_agent is not specified", setting))
+		} else if err := validAgentName(schedule.DestinationAgent); err != nil {
+			errs = append(errs, fmt.Errorf("%s.destination_agent: %v", setting, err))
+		}
+		if !strings.HasPrefix(schedule.DestinationPath, "/") {
+			errs = append(errs, fmt.Errorf("%s.destination_path '%s' is not an absolute path", setting, schedule.DestinationPath))
+		}
+
+		if !constant.StringInList(schedule.Priority, constant.Priorities) {
+			errs = append(errs, fmt.Errorf("%s.priority '%s' is not supported", setting, schedule.Priority))
+		}
+		switch schedule.IfMissing {
+		case constant.ScheduleIfMissingSkip, constant.ScheduleIfMissingWarn, constant.ScheduleIfMissingFail:
+		default:
+			errs = append(errs, fmt.Errorf("%s.if_missing '%s' is not supported", setting, schedule.IfMissing))
+		}
+		errs = append(errs, validateSourceAction(setting, schedule.SourceAction, schedule.MoveTo, schedule.RenameSuffix)...)
+	}
+	return errs
+}
+
+func validateWatches(watches []WatchConf) ValidationErrors {
+	errs := ValidationErrors{}
+	names := map[string]bool{}
+
+	for i, watch := range watches {
+		setting := fmt.Sprintf("config.watches[%d]", i)
+
+		if watch.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name is not specified", setting))
+		} else if names[watch.Name] {
+			errs = append(errs, fmt.Errorf("%s.name '%s' is used by another watch", setting, watch.Name))
+		}
+		names[watch.Name] = true
+
+		if !filepath.IsAbs(watch.Directory) {
+			errs = append(errs, fmt.Errorf("%s.directory '%s' is not an absolute path", setting, watch.Directory))
+		} else if err := dirCreatable(watch.Directory); err != nil {
+			errs = append(errs, fmt.Errorf("%s.directory: %v", setting, err))
+		}
+
+		if watch.DestinationAgent == "" {
+			errs = append(errs, fmt.Errorf("%s.destination_agent is not specified", setting))
+		} else if err := validAgentName(watch.DestinationAgent); err != nil {
+			errs = append(errs, fmt.Errorf("%s.destination_agent: %v", setting, err))
+		}
+		if !strings.HasPrefix(watch.DestinationPath, "/") {
+			errs = append(errs, fmt.Errorf("%s.destination_path '%s' is not an absolute path", setting, watch.DestinationPath))
+		}
+		if !constant.StringInList(watch.Priority, constant.Priorities) {
+			errs = append(errs, fmt.Errorf("%s.priority '%s' is not supported", setting, watch.Priority))
+		}
+
+		for j, pattern := range watch.Include {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s.include[%d]: %v", setting, j, err))
+			}
+		}
+		for j, pattern := range watch.Exclude {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s.exclude[%d]: %v", setting, j, err))
+			}
+		}
+
+		if watch.StableFor < 0 {
+			errs = append(errs, fmt.Errorf("%s.stable_for must not be negative", setting))
+		}
+		if strings.ContainsAny(watch.Marker, `/\`) {
+			errs = append(errs, fmt.Errorf("%s.marker '%s' must be a file name suffix", setting, watch.Marker))
+		}
+
+		errs = append(errs, validateSourceAction(setting, watch.SourceAction, watch.MoveTo, watch.RenameSuffix)...)
+		if watch.SourceAction == constant.SourceActionMove && filepath.Clean(watch.MoveTo) == filepath.Clean(watch.Directory) {
+			errs = append(errs, fmt.Errorf("%s.move_to must not be the watched directory", setting))
+		}
+	}
+	return errs
+}
+
+// validateSourceAction checks what is done with sent files, along with the
+// settings only used by some actions
+func validateSourceAction(setting string, action string, moveTo string, renameSuffix string) ValidationErrors {
+	errs := ValidationErrors{}
+
+	if !constant.StringInList(action, constant.SourceActions) {
+		errs = append(errs, fmt.Errorf("%s.source_action '%s' is not supported", setting, action))
+	}
+
+	if action == constant.SourceActionMove {
+		if !filepath.IsAbs(moveTo) {
+			errs = append(errs, fmt.Errorf("%s.move_to '%s' is not an absolute path", setting, moveTo))
+		} else if err := dirCreatable(moveTo); err != nil {
+			errs = append(errs, fmt.Errorf("%s.move_to: %v", setting, err))
+		}
+	} else if moveTo != "" {
+		errs = append(errs, fmt.Errorf("%s.move_to is only used when source_action is '%s'", setting, constant.SourceActionMove))
+	}
+
+	if action == constant.SourceActionRename {
+		if strings.ContainsAny(renameSuffix, `/\`) {
+			errs = append(errs, fmt.Errorf("%s.rename_suffix '%s' must be a file name suffix", setting, renameSuffix))
+		}
+	} else if renameSuffix != "" {
+		errs = append(errs, fmt.Errorf("%s.rename_suffix is only used when source_action is '%s'", setting, constant.SourceActionRename))
+	}
+	return errs
+}
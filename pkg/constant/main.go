@@ -1,21 +1,185 @@
 package constant
 
-import "github.com/google/uuid"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 const (
 	PublicKeyContainerName = "publickeys"
 
-	MaxConcurrentTransfers = 4
+	PendingKeyContainerName = "pendingkeys"
+
+	// DeadLetterQueueSuffix names the queue holding the messages an agent could not process
+	DeadLetterQueueSuffix = "-deadletter"
+
+	// HighPriorityQueueSuffix and BulkPriorityQueueSuffix name the priority
+	// lanes of an agent, normal priority messages use the queue named after it
+	HighPriorityQueueSuffix = "-high"
+
+	BulkPriorityQueueSuffix = "-bulk"
 
-	MaxRetriesThreshold = 1
+	RevocationListBlobName = "revocations.json"
+
+	RevocationRefreshInterval = time.Minute * 5
 )
 
+// Daemon defaults, each can be changed in the daemon section of the config
+const (
+	// DefaultWorkers is how many uploads and downloads run at once
+	DefaultWorkers = 4
+
+	// DefaultControlWorkers is how many requests and handshakes are handled at once
+	DefaultControlWorkers = 4
+
+	// DefaultDataBacklog is how many transfers may wait for a free worker
+	DefaultDataBacklog = 16
+
+	DefaultMaxRetries = 5
+
+	DefaultVisibilityTimeout = time.Second * 60
+
+	DefaultLeaseExtension = time.Second * 120
+
+	DefaultMessageTTL = time.Minute * 60
+
+	// DefaultDrainTimeout is how long active transfers may run after a shutdown signal
+	DefaultDrainTimeout = time.Second * 60
+
+	// MaxVisibilityTimeout is the longest a queue message can be hidden for
+	MaxVisibilityTimeout = time.Hour * 24 * 7
+
+	// DefaultPollIntervalMin is how soon the queue is polled again while messages keep arriving
+	DefaultPollIntervalMin = time.Millisecond * 250
+
+	// DefaultPollIntervalMax is the slowest the queue is polled while it stays empty
+	DefaultPollIntervalMax = time.Second * 10
+
+	// DefaultBackoffMax caps the wait between retries when the queue cannot be reached
+	DefaultBackoffMax = time.Second * 60
+
+	// DefaultFailureThreshold is how many polls in a row may fail before the agent reports degraded health
+	DefaultFailureThreshold = 5
+
+	// BackoffBase is the wait after the first failed poll
+	BackoffBase = time.Second
+
+	// PoolFullDelay is how long a message is hidden when it is released because its pool is full
+	PoolFullDelay = time.Second * 15
+)
+
+// Health statuses reported by the daemon
+const (
+	HealthStatusHealthy = "healthy"
+
+	// HealthStatusDegraded is reported while the queue cannot be reached
+	HealthStatusDegraded = "degraded"
+
+	HealthStatusStopped = "stopped"
+
+	// HealthHeartbeatInterval is how often the daemon refreshes its health file
+	HealthHeartbeatInterval = time.Second * 30
+
+	// HealthStaleAfter is how old a health file may be before the daemon is considered down
+	HealthStaleAfter = HealthHeartbeatInterval * 4
+)
+
+var MessageTypes = []string{
+	FileRequestMessageType,
+	FileHandshakeMessageType,
+	FileHandshakeResponseMessageType,
+	FileAvailableMessageType,
+	FileReceiptMessageType,
+}
+
+// Identity key algorithms. KeyAlgorithmRSA signs with PKCS#1 v1.5 and is
+// the default for compatibility with agents that predate algorithm agility.
+const (
+	KeyAlgorithmRSA = "rsa"
+
+	KeyAlgorithmRSAPSS = "rsa-pss"
+
+	KeyAlgorithmEd25519 = "ed25519"
+
+	KeyAlgorithmECDSAP256 = "ecdsa-p256"
+)
+
+var KeyAlgorithms = []string{
+	KeyAlgorithmRSA,
+	KeyAlgorithmRSAPSS,
+	KeyAlgorithmEd25519,
+	KeyAlgorithmECDSAP256,
+}
+
+// Key providers hold the private key of this agent
+const (
+	KeyProviderFile = "file"
+
+	KeyProviderAgent = "agent"
+)
+
+// Trust modes decide how keys of allowed agents get pinned in the trust store
+const (
+	TrustModeTOFU = "tofu"
+
+	TrustModeExplicit = "explicit"
+)
+
+// Azure credential modes select how the agent authenticates with storage
+const (
+	AzureCredentialSharedKey = "shared_key"
+
+	AzureCredentialConnectionString = "connection_string"
+
+	AzureCredentialSAS = "sas"
+
+	AzureCredentialManagedIdentity = "managed_identity"
+
+	AzureCredentialWorkloadIdentity = "workload_identity"
+)
+
+// Policy rules apply to files a peer sends to this agent (receive) or
+// requests from it (serve)
+const (
+	PolicyDirectionReceive = "receive"
+
+	PolicyDirectionServe = "serve"
+
+	PolicyDefaultAllow = "allow"
+
+	PolicyDefaultDeny = "deny"
+)
+
+// ParseTimeWindow parses a local time of day window such as '08:00-18:00'
+// into minutes after midnight. The end may be before the start for windows
+// that span midnight.
+func ParseTimeWindow(window string) (int, int, error) {
+	bounds := strings.Split(window, "-")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("time window '%s' is not in the form HH:MM-HH:MM", window)
+	}
+
+	minutes := []int{}
+	for _, bound := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return 0, 0, fmt.Errorf("time window '%s' is not in the form HH:MM-HH:MM", window)
+		}
+		minutes = append(minutes, t.Hour()*60+t.Minute())
+	}
+	return minutes[0], minutes[1], nil
+}
+
 func AgentKeyName(agentName string, keyID string) string {
 	return agentName + "/" + keyID
 }
 
 func VerifierString(m Message) []byte {
-	return []byte(m.ID + m.KeyID + m.Agent + m.Type + string(m.Payload))
+	// Alg is omitted from legacy RSA messages so it only contributes when set
+	return []byte(m.ID + m.KeyID + m.Agent + m.Type + string(m.Payload) + m.Alg)
 }
 
 func StringInList(str string, list []string) bool {
@@ -27,10 +191,190 @@ func StringInList(str string, list []string) bool {
 	return false
 }
 
+// SplitCommand splits a command line into arguments at whitespace. Single
+// and double quotes group words into one argument and are removed; no other
+// shell syntax is interpreted.
+func SplitCommand(command string) ([]string, error) {
+	args := []string{}
+	current := strings.Builder{}
+	inArg := false
+	var quote rune
+
+	for _, r := range command {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("command has an unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("command is empty")
+	}
+	return args, nil
+}
+
 func GetUUID() (string, error) {
 	UUID, err := uuid.NewRandom()
 	if err != nil {
 		return "", err
 	}
 	return UUID.String(), nil
-}
\ No newline at end of file
+}
+
+// Transfer priorities. Each has its own queue per agent, and every message of
+// a transfer is sent on the lane of the priority it was started with.
+const (
+	PriorityHigh = "high"
+
+	PriorityNormal = "normal"
+
+	PriorityBulk = "bulk"
+)
+
+// Priorities lists the priorities from most to least urgent
+var Priorities = []string{
+	PriorityHigh,
+	PriorityNormal,
+	PriorityBulk,
+}
+
+// DefaultPriorityWeights sets how often each lane is polled first when
+// several hold messages
+var DefaultPriorityWeights = map[string]int{
+	PriorityHigh:   6,
+	PriorityNormal: 3,
+	PriorityBulk:   1,
+}
+
+// What a schedule does when its source matches no files
+const (
+	// ScheduleIfMissingSkip records the run as skipped
+	ScheduleIfMissingSkip = "skip"
+
+	// ScheduleIfMissingWarn records the run as skipped and logs a warning
+	ScheduleIfMissingWarn = "warn"
+
+	// ScheduleIfMissingFail records the run as failed and logs an error
+	ScheduleIfMissingFail = "fail"
+)
+
+// Outcomes of a scheduled run recorded in the schedule history
+const (
+	ScheduleRunSent = "sent"
+
+	ScheduleRunSkipped = "skipped"
+
+	ScheduleRunFailed = "failed"
+)
+
+// ScheduleCatchUpLimit bounds the missed runs counted after downtime
+const ScheduleCatchUpLimit = 1000
+
+// DefaultWatchStableFor is how long a dropped file must stay unchanged before
+// a watch sends it
+const DefaultWatchStableFor = 10 * time.Second
+
+// How often a watch checks whether dropped files are complete, and rescans
+// its directory for files whose events were missed
+const (
+	WatchCheckInterval  = time.Second
+	WatchRescanInterval = time.Minute
+)
+
+// What the source agent does with a file once its delivery is confirmed
+const (
+	SourceActionKeep = "keep"
+
+	SourceActionDelete = "delete"
+
+	// SourceActionMove moves the file to another directory
+	SourceActionMove = "move"
+
+	// SourceActionRename adds a suffix to the name of the file
+	SourceActionRename = "rename"
+)
+
+var SourceActions = []string{
+	SourceActionKeep,
+	SourceActionDelete,
+	SourceActionMove,
+	SourceActionRename,
+}
+
+// DefaultRenameSuffix is added to sent files by the rename source action
+const DefaultRenameSuffix = ".sent"
+
+// Points in the life of a transfer at which exits run
+const (
+	// ExitBeforeSend runs before the handshake is sent and vetoes the transfer
+	// when it fails
+	ExitBeforeSend = "before_send"
+
+	ExitAfterUpload = "after_upload"
+
+	ExitReceiptConfirmed = "receipt_confirmed"
+
+	ExitAfterReceive = "after_receive"
+
+	ExitReject = "reject"
+
+	// ExitFailure runs when a message of the transfer is dead-lettered
+	ExitFailure = "failure"
+
+	// ExitExpiry runs when a requested transfer gets no response in time
+	ExitExpiry = "expiry"
+)
+
+var ExitEvents = []string{
+	ExitBeforeSend,
+	ExitAfterUpload,
+	ExitReceiptConfirmed,
+	ExitAfterReceive,
+	ExitReject,
+	ExitFailure,
+	ExitExpiry,
+}
+
+// Sides of a transfer that exits are matched on
+const (
+	DirectionSend = "send"
+
+	DirectionReceive = "receive"
+)
+
+// DefaultExitTimeout is how long an exit may run before it is killed
+const DefaultExitTimeout = time.Minute
+
+// Notification exits run in the background on ExitWorkers workers. Up to
+// ExitQueueSize events wait for them, further events are dropped.
+const (
+	ExitWorkers   = 2
+	ExitQueueSize = 256
+)
+
+// TransferExpiry is how long a requested transfer is kept waiting for the
+// destination agent before it expires
+const TransferExpiry = 5 * time.Hour
+
+// ApprovalExpiry is how long an accepted handshake waits for the sender to
+// upload the file
+const ApprovalExpiry = 24 * time.Hour
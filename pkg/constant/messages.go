@@ -10,12 +10,32 @@ const (
 	FileHandshakeResponseMessageType = "FileHandshakeResponse"
 
 	FileAvailableMessageType = "FileAvailable"
+
+	FileReceiptMessageType = "FileReceipt"
+)
+
+const (
+	// RejectReasonNotAllowed is sent when a path lies outside the roots allowed for the agent
+	RejectReasonNotAllowed = "NOT_ALLOWED"
+
+	// RejectReasonFileTooLarge is sent when a file exceeds the size allowed by policy
+	RejectReasonFileTooLarge = "FILE_TOO_LARGE"
+
+	// RejectReasonOutsideWindow is sent when a transfer is attempted outside the allowed times of day
+	RejectReasonOutsideWindow = "OUTSIDE_WINDOW"
+
+	// RejectReasonQuotaExceeded is sent when a transfer would exceed the daily quota of the peer
+	RejectReasonQuotaExceeded = "QUOTA_EXCEEDED"
+
+	// RejectReasonVetoed is sent when a before_send exit fails
+	RejectReasonVetoed = "VETOED"
 )
 
 // Message contains the overall structure of all messages sent to the queue
 type Message struct {
 	ID        string          `json:"id"`
 	KeyID     string          `json:"key_id"`
+	Alg       string          `json:"alg,omitempty"`
 	Agent     string          `json:"agent"`
 	Type      string          `json:"type"`
 	Payload   json.RawMessage `json:"payload"`
@@ -24,9 +44,28 @@ type Message struct {
 
 // FileRequestMessage contains the structure of the file request message
 type FileRequestMessage struct {
-	FileName            string `json:"file_name"`
-	DestinationAgent    string `json:"destination_agent"`
-	DestinationFileName string `json:"destination_file_name"`
+	FileName            string        `json:"file_name"`
+	DestinationAgent    string        `json:"destination_agent"`
+	DestinationFileName string        `json:"destination_file_name"`
+	SourceAction        *SourceAction `json:"source_action,omitempty"`
+}
+
+// SourceAction is what the source agent does with a file once the destination
+// agent has confirmed its delivery. It is only honoured on requests an agent
+// sends to itself.
+type SourceAction struct {
+	Action       string `json:"action"`
+	MoveTo       string `json:"move_to,omitempty"`
+	RenameSuffix string `json:"rename_suffix,omitempty"`
+}
+
+// NewSourceAction returns the source action to request, or nil when the file
+// is to be kept
+func NewSourceAction(action string, moveTo string, renameSuffix string) *SourceAction {
+	if action == "" || action == SourceActionKeep {
+		return nil
+	}
+	return &SourceAction{Action: action, MoveTo: moveTo, RenameSuffix: renameSuffix}
 }
 
 // FileHandshakeMessage contains the structure of the file handshake message
@@ -43,6 +82,28 @@ type FileHandshakeResponseMessage struct {
 
 // FileAvailableMessage contains the structure of the file available message
 type FileAvailableMessage struct {
-	SignedURL string `json:"signed_url"`
-	FileName  string `json:"file_name"`
+	SignedURL        string `json:"signed_url"`
+	FileName         string `json:"file_name"`
+	ReceiptRequested bool   `json:"receipt_requested,omitempty"`
+}
+
+// FileReceiptMessage confirms that the destination agent has downloaded a file
+type FileReceiptMessage struct {
+	FileName string `json:"file_name"`
+	FileSize int64  `json:"file_size"`
+}
+
+// DeadLetterMessage wraps a message that could not be processed with the
+// details of its last failure
+type DeadLetterMessage struct {
+	QueueMessageID string `json:"queue_message_id"`
+	TransferID     string `json:"transfer_id,omitempty"`
+	Agent          string `json:"agent,omitempty"`
+	Type           string `json:"type,omitempty"`
+	Handler        string `json:"handler,omitempty"`
+	LastError      string `json:"last_error"`
+	Priority       string `json:"priority,omitempty"`
+	DequeueCount   int64  `json:"dequeue_count"`
+	FailedAt       int64  `json:"failed_at"`
+	Message        string `json:"message"`
 }
@@ -0,0 +1,117 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-queue-go/azqueue"
+	"github.com/sirupsen/logrus"
+	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/deadletter"
+	"github.com/willhackett/azure-mft/pkg/exits"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+type failure struct {
+	handler string
+	err     error
+}
+
+// failures holds the last failure of each message that is being retried so
+// that it can be kept with the message if it is dead-lettered. Failures seen
+// by other instances are not known here.
+var failures = struct {
+	sync.Mutex
+	last map[azqueue.MessageID]failure
+}{last: map[azqueue.MessageID]failure{}}
+
+// permanentError marks a failure that a retry cannot fix, such as a message
+// rejected by the allow lists
+type permanentError struct {
+	error
+}
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// fail records why a message could not be processed. On its last attempt, or
+// when the failure is permanent, the message is moved to the dead-letter
+// queue, otherwise it is left to become visible again for a retry.
+func fail(qm *QueueMessage, handler string, err error) {
+	log := logger.Get().WithFields(logrus.Fields{
+		"event":            "HandleMessage",
+		"queue_message_id": qm.id,
+	})
+
+	failures.Lock()
+	failures.last[qm.id] = failure{handler, err}
+	failures.Unlock()
+
+	var permanentErr permanentError
+	if !qm.lastAttempt && !errors.As(err, &permanentErr) {
+		log.Warn("Failed to process message, releasing to queue", err)
+		return
+	}
+	deadLetter(qm)
+}
+
+// deadLetter moves a message to the dead-letter queue with its last failure
+func deadLetter(qm *QueueMessage) {
+	log := logger.Get().WithFields(logrus.Fields{
+		"event":            "DeadLetter",
+		"queue_message_id": qm.id,
+	})
+
+	failures.Lock()
+	last, ok := failures.last[qm.id]
+	failures.Unlock()
+
+	message := constant.DeadLetterMessage{
+		QueueMessageID: string(qm.id),
+		Handler:        last.handler,
+		Priority:       qm.priority,
+		DequeueCount:   qm.dequeueCount,
+		FailedAt:       time.Now().Unix(),
+		Message:        qm.text,
+	}
+	if ok {
+		message.LastError = last.err.Error()
+	} else {
+		message.LastError = fmt.Sprintf("delivered %d times without being processed", qm.dequeueCount)
+	}
+
+	// The envelope is read without verifying it to describe the message
+	envelope := constant.Message{}
+	if json.Unmarshal([]byte(qm.text), &envelope) == nil {
+		message.TransferID = envelope.ID
+		message.Agent = envelope.Agent
+		message.Type = envelope.Type
+	}
+
+	if err := deadletter.Send(message); err != nil {
+		// Leave the message on the queue rather than lose it
+		log.Error("Failed to move message to the dead-letter queue", err)
+		return
+	}
+	qm.Delete()
+
+	failures.Lock()
+	delete(failures.last, qm.id)
+	failures.Unlock()
+
+	log.WithField("last_error", message.LastError).Warn(fmt.Sprintf("Moved message to the dead-letter queue after %d deliveries", qm.dequeueCount))
+
+	exits.Notify(failureEvent(message, envelope.Payload))
+}
+
+// forgetFailure drops the failure of a message once it has been processed
+func forgetFailure(qm *QueueMessage) {
+	failures.Lock()
+	defer failures.Unlock()
+
+	delete(failures.last, qm.id)
+}
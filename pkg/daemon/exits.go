@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"encoding/json"
+
+	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/exits"
+	"github.com/willhackett/azure-mft/pkg/registry"
+)
+
+// sendEvent describes a transfer this agent sends for its exits
+func sendEvent(event string, id string, details constant.FileRequestMessage, priority string) exits.Event {
+	return exits.Event{
+		Event:          event,
+		Direction:      constant.DirectionSend,
+		TransferID:     id,
+		Agent:          details.DestinationAgent,
+		FileName:       details.FileName,
+		RemoteFileName: details.DestinationFileName,
+		Priority:       priority,
+	}
+}
+
+// receiveEvent describes a transfer this agent receives for its exits
+func receiveEvent(event string, id string, agentName string, fileName string, priority string) exits.Event {
+	return exits.Event{
+		Event:      event,
+		Direction:  constant.DirectionReceive,
+		TransferID: id,
+		Agent:      agentName,
+		FileName:   fileName,
+		Priority:   priority,
+	}
+}
+
+// failureEvent describes the transfer of a dead-lettered message. Messages of
+// transfers this agent sends are matched to the transfer, others are
+// described from their payload, which is not verified.
+func failureEvent(message constant.DeadLetterMessage, payload json.RawMessage) exits.Event {
+	if transfer, ok := registry.GetTransfer(message.TransferID); ok {
+		registry.DeleteTransfer(message.TransferID)
+		event := sendEvent(constant.ExitFailure, message.TransferID, transfer.Details, message.Priority)
+		event.Error = message.LastError
+		return event
+	}
+
+	body := struct {
+		FileName string `json:"file_name"`
+	}{}
+	json.Unmarshal(payload, &body)
+
+	event := receiveEvent(constant.ExitFailure, message.TransferID, message.Agent, body.FileName, message.Priority)
+	switch message.Type {
+	case constant.FileRequestMessageType, constant.FileHandshakeResponseMessageType, constant.FileReceiptMessageType:
+		event.Direction = constant.DirectionSend
+	case constant.FileHandshakeMessageType, constant.FileAvailableMessageType:
+	default:
+		event.Direction = ""
+	}
+	event.Error = message.LastError
+	return event
+}
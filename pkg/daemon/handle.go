@@ -1,6 +1,7 @@
 package daemon
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,14 +10,18 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/willhackett/azure-mft/pkg/azure"
+	"github.com/willhackett/azure-mft/pkg/config"
 	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/exits"
 	"github.com/willhackett/azure-mft/pkg/keys"
 	"github.com/willhackett/azure-mft/pkg/logger"
+	"github.com/willhackett/azure-mft/pkg/policy"
 	"github.com/willhackett/azure-mft/pkg/registry"
+	"github.com/willhackett/azure-mft/pkg/sandbox"
 	"github.com/willhackett/azure-mft/pkg/tasks"
 )
 
-func handleFileRequest(m constant.Message) error {
+func handleFileRequest(ctx context.Context, m constant.Message, priority string) error {
 	log := logger.Get().WithFields(logrus.Fields{
 		"id":    m.ID,
 		"event": "HandleFileRequest",
@@ -26,13 +31,34 @@ func handleFileRequest(m constant.Message) error {
 		return err
 	}
 
-	registry.AddTransfer(m.ID, body, 5*60*60*1000)
+	// Rejected requests are reported to the exits of this agent and to the requester
+	reject := func(reason string, detail string) error {
+		event := sendEvent(constant.ExitReject, m.ID, body, priority)
+		event.Reason = reason
+		event.Error = detail
+		exits.Notify(event)
+		return tasks.SendFileHandshakeResponse(m.ID, false, m.Agent, reason, priority)
+	}
+
+	fileName, err := sandbox.ServePath(m.Agent, body.FileName)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Agent %s is not allowed to read %s", m.Agent, body.FileName), err)
+		policy.Reject(m.ID, m.Agent, constant.PolicyDirectionServe, body.FileName, constant.RejectReasonNotAllowed, err.Error())
+		return reject(constant.RejectReasonNotAllowed, err.Error())
+	}
+	body.FileName = fileName
+
+	// Other agents may not have this agent delete or move its files
+	if m.Agent != config.GetConfig().Agent.Name {
+		body.SourceAction = nil
+	}
 
 	file, err := os.Open(body.FileName)
 	if err != nil {
 		log.Error("Cannot open file for reading", err)
 		return err
 	}
+	defer file.Close()
 
 	fileInfo, err := file.Stat()
 	if err != nil {
@@ -43,10 +69,34 @@ func handleFileRequest(m constant.Message) error {
 	fileSize := fileInfo.Size()
 	log.Debug(fmt.Sprintf("File size: %d", fileSize))
 
-	return tasks.SendFileHandshake(m.ID, body.DestinationFileName, fileSize, body.DestinationAgent)
+	// The version of the file is kept to check a delivery receipt against
+	registry.AddTransfer(m.ID, body, fileSize, fileInfo.ModTime().UnixNano(), int64(constant.TransferExpiry.Seconds()))
+
+	decision := policy.Evaluate(m.ID, m.Agent, constant.PolicyDirectionServe, body.FileName, fileSize)
+	if !decision.Allowed {
+		registry.DeleteTransfer(m.ID)
+		return reject(decision.Reason, decision.Detail)
+	}
+
+	beforeSend := sendEvent(constant.ExitBeforeSend, m.ID, body, priority)
+	beforeSend.FileSize = fileSize
+	if err := exits.Allow(beforeSend); err != nil {
+		log.Warn("Transfer vetoed by before_send exit", err)
+		registry.DeleteTransfer(m.ID)
+		policy.Release(m.ID, m.Agent, constant.PolicyDirectionServe, fileSize)
+		policy.Reject(m.ID, m.Agent, constant.PolicyDirectionServe, body.FileName, constant.RejectReasonVetoed, err.Error())
+		return reject(constant.RejectReasonVetoed, err.Error())
+	}
+
+	// A retry counts the transfer again
+	if err := tasks.SendFileHandshake(m.ID, body.DestinationFileName, fileSize, body.DestinationAgent, priority); err != nil {
+		policy.Release(m.ID, m.Agent, constant.PolicyDirectionServe, fileSize)
+		return err
+	}
+	return nil
 }
 
-func handleFileHandshake(m constant.Message) error {
+func handleFileHandshake(ctx context.Context, m constant.Message, priority string) error {
 	log := logger.Get().WithFields(logrus.Fields{
 		"id":    m.ID,
 		"event": "HandleFileHandshake",
@@ -58,19 +108,53 @@ func handleFileHandshake(m constant.Message) error {
 		return err
 	}
 
-	_, err := os.OpenFile(body.FileName, os.O_RDWR|os.O_CREATE, 0755)
+	// Rejected handshakes are reported to the exits of this agent and to the sender
+	reject := func(reason string, detail string) error {
+		event := receiveEvent(constant.ExitReject, m.ID, m.Agent, body.FileName, priority)
+		event.FileSize = body.FileSize
+		event.Reason = reason
+		event.Error = detail
+		exits.Notify(event)
+		return tasks.SendFileHandshakeResponse(m.ID, false, m.Agent, reason, priority)
+	}
+
+	fileName, err := sandbox.ReceivePath(m.Agent, body.FileName)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Agent %s is not allowed to write %s", m.Agent, body.FileName), err)
+		policy.Reject(m.ID, m.Agent, constant.PolicyDirectionReceive, body.FileName, constant.RejectReasonNotAllowed, err.Error())
+		return reject(constant.RejectReasonNotAllowed, err.Error())
+	}
+	body.FileName = fileName
+
+	decision := policy.Evaluate(m.ID, m.Agent, constant.PolicyDirectionReceive, body.FileName, body.FileSize)
+	if !decision.Allowed {
+		return reject(decision.Reason, decision.Detail)
+	}
+
+	file, err := os.OpenFile(body.FileName, os.O_RDWR|os.O_CREATE, 0755)
 	if err != nil {
 		log.Error(fmt.Sprintf("Cannot open destination path: %s", body.FileName), err)
-		tasks.SendFileHandshakeResponse(m.ID, false, m.Agent, fmt.Sprintf("Cannot open destination path: %s", body.FileName))
+		policy.Release(m.ID, m.Agent, constant.PolicyDirectionReceive, body.FileSize)
+		reject(fmt.Sprintf("Cannot open destination path: %s", body.FileName), err.Error())
 		return nil
 	}
+	file.Close()
 
-	err = tasks.SendFileHandshakeResponse(m.ID, true, m.Agent, "")
+	// Only the approved path and size may be written when the file is available
+	if err := registry.AddApproval(m.ID, m.Agent, body.FileName, body.FileSize); err != nil {
+		log.Error("Cannot record approval of file handshake", err)
+		policy.Release(m.ID, m.Agent, constant.PolicyDirectionReceive, body.FileSize)
+		return err
+	}
 
-	return err
+	if err := tasks.SendFileHandshakeResponse(m.ID, true, m.Agent, "", priority); err != nil {
+		policy.Release(m.ID, m.Agent, constant.PolicyDirectionReceive, body.FileSize)
+		return err
+	}
+	return nil
 }
 
-func handleFileHandshakeResponse(qm *QueueMessage, m constant.Message) error {
+func handleFileHandshakeResponse(ctx context.Context, m constant.Message, priority string) error {
 	log := logger.Get().WithFields(logrus.Fields{
 		"id":    m.ID,
 		"event": "HandleFileHandshakeResponse",
@@ -83,29 +167,50 @@ func handleFileHandshakeResponse(qm *QueueMessage, m constant.Message) error {
 		return err
 	}
 
-	if !body.Accepted {
-		log.Warn("File handshake was not accepted, end of transaction.")
-		return nil
-	}
-
 	transfer, ok := registry.GetTransfer(m.ID)
 	if !ok {
+		// Requests this agent rejected itself were reported when they were rejected
+		if !body.Accepted {
+			log.Warn(fmt.Sprintf("File request was not accepted (%s), end of transaction.", body.Reason))
+			return nil
+		}
 		log.Debug("Cannot find transfer", m.ID)
 		return errors.New("transfer expired or did not originate from this node")
 	}
 
+	// Only the destination agent may answer for the transfer
+	if transfer.Details.DestinationAgent != m.Agent {
+		log.Warn(fmt.Sprintf("Agent %s is not the destination of this transfer, response ignored", m.Agent))
+		return nil
+	}
+
+	if !body.Accepted {
+		log.Warn(fmt.Sprintf("File handshake was not accepted (%s), end of transaction.", body.Reason))
+		registry.DeleteTransfer(m.ID)
+
+		event := sendEvent(constant.ExitReject, m.ID, transfer.Details, priority)
+		event.Agent = m.Agent
+		event.Reason = body.Reason
+		exits.Notify(event)
+		return nil
+	}
+
+	// The transfer does not expire while it is being uploaded
+	expiresIn := int64(constant.TransferExpiry.Seconds())
+	registry.Touch(m.ID, expiresIn)
+
 	debounce := time.Now().Add(time.Second * 30).Unix()
 
 	reportProgress := func(bytes int64) {
 		if time.Now().Unix() > debounce {
-			qm.IncreaseLease()
-			log.Debug(fmt.Sprintf("Uploaded bytes: %d and increased message visibility timeout", bytes))
+			log.Debug(fmt.Sprintf("Uploaded bytes: %d", bytes))
+			registry.Touch(m.ID, expiresIn)
 			debounce = time.Now().Add(time.Second * 30).Unix()
 		}
 	}
 	log.Info(fmt.Sprintf("Uploading file %s", transfer.Details.FileName))
 
-	signedURL, err := azure.UploadFromFile(transfer.Details.DestinationAgent, m.ID, transfer.Details.FileName, reportProgress)
+	signedURL, err := azure.UploadFromFile(ctx, transfer.Details.DestinationAgent, m.ID, transfer.Details.FileName, reportProgress)
 	if err != nil {
 		log.Error("Failed to upload file", err)
 		return err
@@ -117,12 +222,25 @@ func handleFileHandshakeResponse(qm *QueueMessage, m constant.Message) error {
 		return err
 	}
 
-	err = tasks.SendFileAvailable(m.ID, encryptedSignedURL, transfer.Details.DestinationFileName, transfer.Details.DestinationAgent)
+	// A receipt is only needed to act on the source file or run exits once it is delivered
+	receiptRequested := transfer.Details.SourceAction != nil || exits.Wanted(constant.ExitReceiptConfirmed)
+	err = tasks.SendFileAvailable(m.ID, encryptedSignedURL, transfer.Details.DestinationFileName, transfer.Details.DestinationAgent, receiptRequested, priority)
+	if err != nil {
+		return err
+	}
 
-	return err
+	// Without a receipt to wait for the transfer is done here, otherwise the
+	// destination agent has the full expiry to download the file
+	if receiptRequested {
+		registry.Touch(m.ID, expiresIn)
+	} else {
+		registry.DeleteTransfer(m.ID)
+	}
+	exits.Notify(sendEvent(constant.ExitAfterUpload, m.ID, transfer.Details, priority))
+	return nil
 }
 
-func handleFileAvailable(qm *QueueMessage, m constant.Message) error {
+func handleFileAvailable(ctx context.Context, m constant.Message, priority string) error {
 	log := logger.Get().WithFields(logrus.Fields{
 		"id":    m.ID,
 		"event": "HandleFileAvailable",
@@ -134,6 +252,32 @@ func handleFileAvailable(qm *QueueMessage, m constant.Message) error {
 		return err
 	}
 
+	// Rejected downloads are reported to the sender so that its transfer ends
+	// rather than waiting to expire
+	reject := func(reason string, detail string) error {
+		log.Warn(fmt.Sprintf("Agent %s is not allowed to write %s: %s", m.Agent, body.FileName, detail))
+		policy.Reject(m.ID, m.Agent, constant.PolicyDirectionReceive, body.FileName, reason, detail)
+		if err := tasks.SendFileHandshakeResponse(m.ID, false, m.Agent, reason, priority); err != nil {
+			log.Error("Cannot send rejection of file available", err)
+		}
+		return permanent(fmt.Errorf("agent %s is not allowed to write %s: %s", m.Agent, body.FileName, detail))
+	}
+
+	// The handshake was checked already, but the sender may name a different path here
+	fileName, err := sandbox.ReceivePath(m.Agent, body.FileName)
+	if err != nil {
+		return reject(constant.RejectReasonNotAllowed, err.Error())
+	}
+	body.FileName = fileName
+
+	approval, ok := registry.GetApproval(m.ID)
+	if !ok || approval.Agent != m.Agent {
+		return reject(constant.RejectReasonNotAllowed, "no handshake was accepted for this transfer")
+	}
+	if approval.FileName != body.FileName {
+		return reject(constant.RejectReasonNotAllowed, fmt.Sprintf("the accepted handshake was for %s", approval.FileName))
+	}
+
 	signedURL, err := keys.DecryptString(body.SignedURL)
 	if err != nil {
 		log.Error("Failed to decrypt signed URL", err)
@@ -142,19 +286,117 @@ func handleFileAvailable(qm *QueueMessage, m constant.Message) error {
 
 	debounce := time.Now().Add(time.Second * 30).Unix()
 
+	// The download stops once it is larger than the approved size
+	downloadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tooLarge := false
+
 	reportProgress := func(bytes int64) {
+		if bytes > approval.FileSize {
+			tooLarge = true
+			cancel()
+		}
 		if time.Now().Unix() > debounce {
-			qm.IncreaseLease()
-			log.Debug(fmt.Sprintf("Downloaded bytes: %d and increased message visibility timeout", bytes))
+			log.Debug(fmt.Sprintf("Downloaded bytes: %d", bytes))
 			debounce = time.Now().Add(time.Second * 30).Unix()
 		}
 	}
 	log.Info(fmt.Sprintf("Downloading file from %s to %s", m.Agent, body.FileName))
 
-	err = azure.DownloadSignedURLToFile(signedURL, body.FileName, reportProgress)
+	err = azure.DownloadSignedURLToFile(downloadCtx, signedURL, body.FileName, reportProgress)
+	if err == nil && !tooLarge {
+		if fileInfo, statErr := os.Stat(body.FileName); statErr == nil && fileInfo.Size() > approval.FileSize {
+			tooLarge = true
+		}
+	}
+	if tooLarge {
+		os.Remove(body.FileName)
+		registry.DeleteApproval(m.ID)
+		return reject(constant.RejectReasonFileTooLarge, fmt.Sprintf("file is larger than the %d bytes accepted", approval.FileSize))
+	}
 	if err != nil {
 		log.Error(fmt.Sprintf("Failed to download file: %s", body.FileName), err)
+		return err
 	}
 	log.Info(fmt.Sprintf("Downloaded file: %s", body.FileName))
+
+	if err := registry.DeleteApproval(m.ID); err != nil {
+		log.Error("Cannot remove approval of file handshake", err)
+	}
+
+	// The file is delivered, failing now would only download it again. Without
+	// a receipt the sender keeps its file.
+	fileInfo, err := os.Stat(body.FileName)
+	if err != nil {
+		log.Error("Cannot read downloaded file information", err)
+		return nil
+	}
+
+	afterReceive := receiveEvent(constant.ExitAfterReceive, m.ID, m.Agent, body.FileName, priority)
+	afterReceive.FileSize = fileInfo.Size()
+	exits.Notify(afterReceive)
+
+	if !body.ReceiptRequested {
+		return nil
+	}
+	if err := tasks.SendFileReceipt(m.ID, body.FileName, fileInfo.Size(), m.Agent, priority); err != nil {
+		log.Error("Cannot send file receipt", err)
+	}
+	return nil
+}
+
+func handleFileReceipt(ctx context.Context, m constant.Message, priority string) error {
+	log := logger.Get().WithFields(logrus.Fields{
+		"id":    m.ID,
+		"event": "HandleFileReceipt",
+	})
+	log.Info(fmt.Sprintf("Received file receipt from %s", m.Agent))
+
+	body := constant.FileReceiptMessage{}
+	if err := json.Unmarshal(m.Payload, &body); err != nil {
+		return err
+	}
+
+	// Without the transfer, such as after a restart, the source file is kept
+	transfer, ok := registry.GetTransfer(m.ID)
+	if !ok {
+		log.Warn("Cannot find transfer for receipt, source file kept")
+		return nil
+	}
+	if transfer.Details.DestinationAgent != m.Agent {
+		log.Warn(fmt.Sprintf("Agent %s is not the destination of this transfer, receipt ignored", m.Agent))
+		return nil
+	}
+	registry.DeleteTransfer(m.ID)
+
+	receiptConfirmed := sendEvent(constant.ExitReceiptConfirmed, m.ID, transfer.Details, priority)
+	receiptConfirmed.RemoteFileName = body.FileName
+	receiptConfirmed.FileSize = body.FileSize
+	exits.Notify(receiptConfirmed)
+
+	if transfer.Details.SourceAction == nil {
+		return nil
+	}
+
+	// A file that changed since it was requested is kept
+	fileInfo, err := os.Stat(transfer.Details.FileName)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Cannot read source file %s, no source action taken", transfer.Details.FileName), err)
+		return nil
+	}
+	if fileInfo.Size() != transfer.FileSize || fileInfo.ModTime().UnixNano() != transfer.ModTime {
+		log.Warn(fmt.Sprintf("Source file %s changed since it was requested, source file kept", transfer.Details.FileName))
+		return nil
+	}
+	if body.FileSize != transfer.FileSize {
+		log.Warn(fmt.Sprintf("Source file %s is %d bytes but %d were delivered, source file kept", transfer.Details.FileName, transfer.FileSize, body.FileSize))
+		return nil
+	}
+
+	if err := disposeSource(m.ID, transfer.Details); err != nil {
+		log.Error(fmt.Sprintf("Cannot %s source file %s", transfer.Details.SourceAction.Action, transfer.Details.FileName), err)
+		return nil
+	}
+	log.Info(fmt.Sprintf("Delivery confirmed, source file %s: %s", transfer.Details.FileName, transfer.Details.SourceAction.Action))
 	return nil
 }
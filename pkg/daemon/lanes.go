@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"github.com/Azure/azure-storage-queue-go/azqueue"
+	"github.com/willhackett/azure-mft/pkg/azure"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+// lane is the queue of the agent for one priority
+type lane struct {
+	priority    string
+	messagesURL azqueue.MessagesURL
+
+	// current is the running score of smooth weighted round robin
+	current int
+}
+
+// lanes holds the lanes from most to least urgent
+type lanes []*lane
+
+func newLanes() lanes {
+	priorityLanes := lanes{}
+	for _, priority := range constant.Priorities {
+		messagesURL, _ := azure.GetMessagesURLAndContext(priority)
+		priorityLanes = append(priorityLanes, &lane{priority: priority, messagesURL: messagesURL})
+	}
+	return priorityLanes
+}
+
+// order returns the lanes in the order to poll them. The first lane is
+// picked by smooth weighted round robin, so that while every lane holds
+// messages each is polled first in proportion to its weight and bulk traffic
+// cannot starve urgent transfers, nor the other way around. The remaining
+// lanes follow from most to least urgent so that an empty lane does not
+// leave the others idle.
+func (l lanes) order(weights map[string]int) []*lane {
+	total := 0
+	var picked *lane
+	for _, priorityLane := range l {
+		weight := weights[priorityLane.priority]
+		priorityLane.current += weight
+		total += weight
+		if picked == nil || priorityLane.current > picked.current {
+			picked = priorityLane
+		}
+	}
+	picked.current -= total
+
+	ordered := []*lane{picked}
+	for _, priorityLane := range l {
+		if priorityLane != picked {
+			ordered = append(ordered, priorityLane)
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,97 @@
+package daemon
+
+import (
+	"testing"
+
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+func testLanes() lanes {
+	priorityLanes := lanes{}
+	for _, priority := range constant.Priorities {
+		priorityLanes = append(priorityLanes, &lane{priority: priority})
+	}
+	return priorityLanes
+}
+
+func TestLanesOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		rounds  int
+		want    map[string]int
+	}{
+		{
+			name:    "in proportion to the weights",
+			weights: map[string]int{constant.PriorityHigh: 4, constant.PriorityNormal: 2, constant.PriorityBulk: 1},
+			rounds:  70,
+			want:    map[string]int{constant.PriorityHigh: 40, constant.PriorityNormal: 20, constant.PriorityBulk: 10},
+		},
+		{
+			name:    "equal weights",
+			weights: map[string]int{constant.PriorityHigh: 1, constant.PriorityNormal: 1, constant.PriorityBulk: 1},
+			rounds:  30,
+			want:    map[string]int{constant.PriorityHigh: 10, constant.PriorityNormal: 10, constant.PriorityBulk: 10},
+		},
+		{
+			name:    "lane without weight is never first",
+			weights: map[string]int{constant.PriorityHigh: 3, constant.PriorityNormal: 1},
+			rounds:  40,
+			want:    map[string]int{constant.PriorityHigh: 30, constant.PriorityNormal: 10},
+		},
+		{
+			name:    "no weights polls the most urgent lane first",
+			weights: map[string]int{},
+			rounds:  10,
+			want:    map[string]int{constant.PriorityHigh: 10},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			priorityLanes := testLanes()
+
+			first := map[string]int{}
+			for round := 0; round < test.rounds; round++ {
+				ordered := priorityLanes.order(test.weights)
+				if len(ordered) != len(priorityLanes) {
+					t.Fatalf("order() returned %d lanes, want %d", len(ordered), len(priorityLanes))
+				}
+				first[ordered[0].priority]++
+
+				// The other lanes follow from most to least urgent
+				rest := []string{}
+				for _, priority := range constant.Priorities {
+					if priority != ordered[0].priority {
+						rest = append(rest, priority)
+					}
+				}
+				for i, priority := range rest {
+					if ordered[i+1].priority != priority {
+						t.Fatalf("round %d: lane %d is %s, want %s", round, i+1, ordered[i+1].priority, priority)
+					}
+				}
+			}
+
+			for _, priority := range constant.Priorities {
+				if first[priority] != test.want[priority] {
+					t.Errorf("%s lane polled first %d times, want %d", priority, first[priority], test.want[priority])
+				}
+			}
+		})
+	}
+}
+
+func TestLanesOrderInterleaves(t *testing.T) {
+	priorityLanes := testLanes()
+	weights := map[string]int{constant.PriorityHigh: 2, constant.PriorityNormal: 1, constant.PriorityBulk: 1}
+
+	// Smooth weighted round robin spreads the picks of a heavy lane rather
+	// than polling it first several times in a row
+	want := []string{constant.PriorityHigh, constant.PriorityNormal, constant.PriorityBulk, constant.PriorityHigh}
+	for round, priority := range want {
+		if got := priorityLanes.order(weights)[0].priority; got != priority {
+			t.Errorf("round %d polled %s first, want %s", round, got, priority)
+		}
+	}
+}
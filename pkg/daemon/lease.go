@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+// leaseCheckInterval is how often leases are checked for renewal
+const leaseCheckInterval = time.Second
+
+// waiting holds the messages dequeued for a pool whose workers are all busy.
+// Their leases are renewed until a worker takes them, so that they are not
+// redelivered while they are still queued locally.
+var waiting = struct {
+	sync.Mutex
+	messages map[*QueueMessage]bool
+}{messages: map[*QueueMessage]bool{}}
+
+func holdMessage(qm *QueueMessage) {
+	waiting.Lock()
+	defer waiting.Unlock()
+
+	waiting.messages[qm] = true
+}
+
+func unholdMessage(qm *QueueMessage) {
+	waiting.Lock()
+	defer waiting.Unlock()
+
+	delete(waiting.messages, qm)
+}
+
+// keepWaitingLeases renews the leases of waiting messages until stop is closed
+func keepWaitingLeases(stop <-chan struct{}) {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			waiting.Lock()
+			expiring := []*QueueMessage{}
+			for qm := range waiting.messages {
+				if qm.leaseExpiring(now) {
+					expiring = append(expiring, qm)
+				}
+			}
+			waiting.Unlock()
+
+			visibilityTimeout := config.GetConfig().Daemon.VisibilityTimeout
+			for _, qm := range expiring {
+				qm.extendLease(visibilityTimeout)
+			}
+		}
+	}
+}
+
+// keepLease renews the lease of a message being handled until finishMessage
+// is called, whether or not its transfer makes progress. The returned context
+// is cancelled if a renewal fails, as the message may then be redelivered to
+// another worker, and the handler should stop.
+func keepLease(qm *QueueMessage) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	qm.lock.Lock()
+	qm.stopLease = cancel
+	qm.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(leaseCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if !qm.leaseExpiring(now) {
+					continue
+				}
+				if err := qm.extendLease(qm.leaseExtension); err != nil {
+					logger.Get().WithFields(logrus.Fields{
+						"event":            "KeepLease",
+						"queue_message_id": qm.id,
+					}).Warn("Lost lease on message, cancelling its handler", err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx
+}
@@ -1,8 +1,13 @@
 package daemon
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Azure/azure-storage-queue-go/azqueue"
@@ -10,14 +15,19 @@ import (
 	"github.com/willhackett/azure-mft/pkg/azure"
 	"github.com/willhackett/azure-mft/pkg/config"
 	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/exits"
 	"github.com/willhackett/azure-mft/pkg/keys"
 	"github.com/willhackett/azure-mft/pkg/logger"
+	"github.com/willhackett/azure-mft/pkg/policy"
+	"github.com/willhackett/azure-mft/pkg/registry"
+	"github.com/willhackett/azure-mft/pkg/schedule"
+	"github.com/willhackett/azure-mft/pkg/watch"
 )
 
 func canAgentSendFile(agentName string) bool {
 	cfg := config.GetConfig()
 
-	return constant.StringInList(agentName, cfg.AllowRequestsFrom)
+	return constant.StringInList(agentName, cfg.AllowFilesFrom)
 }
 
 func canAgentRequestFile(agentName string) bool {
@@ -26,7 +36,10 @@ func canAgentRequestFile(agentName string) bool {
 	return constant.StringInList(agentName, cfg.AllowRequestsFrom) || agentName == cfg.Agent.Name
 }
 
-func handleMessage(qm *QueueMessage) {
+// handleMessage verifies a message and runs its handler. Uploads and
+// downloads are given to handOff, when there is one, to run asynchronously;
+// it reports whether the message was handed off.
+func handleMessage(ctx context.Context, qm *QueueMessage, handOff func(qm *QueueMessage, run func())) bool {
 	log := logger.Get().WithFields(logrus.Fields{
 		"event": "HandleMessage",
 	})
@@ -37,8 +50,9 @@ func handleMessage(qm *QueueMessage) {
 	err := json.Unmarshal([]byte(qm.text), &messageBody)
 	if err != nil {
 		log.Trace(err)
-		log.WithField("message_body", qm.text).Warn("Discarded invalid message payload")
-		return
+		log.WithField("message_body", qm.text).Warn("Invalid message payload")
+		fail(qm, "HandleMessage", err)
+		return false
 	}
 
 	// Verify the contents of the message signature
@@ -46,100 +60,288 @@ func handleMessage(qm *QueueMessage) {
 	if err != nil {
 		log.Trace(err)
 		log.WithField("id", messageBody.ID).WithField("body", qm.text).Warn("Message signature cannot be verified")
-		return
+		fail(qm, "HandleMessage", err)
+		return false
 	}
 
+	var handler string
+	var runTransfer func() error
 	switch messageBody.Type {
 	case constant.FileRequestMessageType:
 		// Check if requesting agent is allowed to request files
 		if !canAgentRequestFile(messageBody.Agent) {
 			log.WithField("id", messageBody.ID).WithField("destination_agent", messageBody.Agent).Warn("Requesting agent is not allowed to request files")
-			return
+			policy.Reject(messageBody.ID, messageBody.Agent, constant.PolicyDirectionServe, "", constant.RejectReasonNotAllowed, "agent is not in allow_requests_from")
+			fail(qm, "HandleMessage", permanent(errors.New("agent is not in allow_requests_from")))
+			return false
 		}
 
-		err = handleFileRequest(messageBody)
+		handler = "HandleFileRequest"
+		err = handleFileRequest(ctx, messageBody, qm.priority)
 	case constant.FileHandshakeMessageType:
 		// Check if requesting agent is allowed to send files
 		if !canAgentSendFile(messageBody.Agent) {
 			log.WithField("id", messageBody.ID).WithField("destination_agent", messageBody.Agent).Warn("Requesting agent is not allowed to send files")
-			return
+			policy.Reject(messageBody.ID, messageBody.Agent, constant.PolicyDirectionReceive, "", constant.RejectReasonNotAllowed, "agent is not in allow_files_from")
+			fail(qm, "HandleMessage", permanent(errors.New("agent is not in allow_files_from")))
+			return false
 		}
 
-		err = handleFileHandshake(messageBody)
+		handler = "HandleFileHandshake"
+		err = handleFileHandshake(ctx, messageBody, qm.priority)
 	case constant.FileHandshakeResponseMessageType:
-		handleFileHandshakeResponse(qm, messageBody)
+		handler = "HandleFileHandshakeResponse"
+		runTransfer = func() error { return handleFileHandshakeResponse(ctx, messageBody, qm.priority) }
 
 	case constant.FileAvailableMessageType:
 		if !canAgentSendFile(messageBody.Agent) {
-			log.WithField("id", messageBody.ID).WithField("destination_agent", messageBody.Agent).Warn("Requesting agent is not allowed to request files")
-			return
+			log.WithField("id", messageBody.ID).WithField("destination_agent", messageBody.Agent).Warn("Requesting agent is not allowed to send files")
+			policy.Reject(messageBody.ID, messageBody.Agent, constant.PolicyDirectionReceive, "", constant.RejectReasonNotAllowed, "agent is not in allow_files_from")
+			fail(qm, "HandleMessage", permanent(errors.New("agent is not in allow_files_from")))
+			return false
 		}
 
-		err = handleFileAvailable(qm, messageBody)
+		handler = "HandleFileAvailable"
+		runTransfer = func() error { return handleFileAvailable(ctx, messageBody, qm.priority) }
+	case constant.FileReceiptMessageType:
+		handler = "HandleFileReceipt"
+		err = handleFileReceipt(ctx, messageBody, qm.priority)
 	default:
 		log.WithField("id", messageBody.ID).WithField("body", qm.text).Warn("Invalid Type on Message")
-		return
+		fail(qm, "HandleMessage", fmt.Errorf("unknown message type '%s'", messageBody.Type))
+		return false
 	}
 
+	if runTransfer != nil && handOff != nil {
+		handOff(qm, func() {
+			completeMessage(qm, messageBody, handler, runTransfer())
+		})
+		return true
+	}
+	if runTransfer != nil {
+		err = runTransfer()
+	}
+
+	completeMessage(qm, messageBody, handler, err)
+	return false
+}
+
+// completeMessage deletes a message once it has been processed, or records
+// the failure of its handler
+func completeMessage(qm *QueueMessage, messageBody constant.Message, handler string, err error) {
+	log := logger.Get().WithFields(logrus.Fields{
+		"event": "HandleMessage",
+		"id":    messageBody.ID,
+	})
+
 	if err != nil {
-		log.WithField("id", messageBody.ID).Warn("Failed to process message, releasing to queue")
+		fail(qm, handler, err)
 		return
 	}
 
-	log.WithField("id", messageBody.ID).Info("Successful " + messageBody.Type + " operation")
-	log.WithField("id", messageBody.ID).Debug("Discarding dequeued message")
-	qm.URL.Delete(qm.context, qm.popReceipt)
+	log.Info("Successful " + messageBody.Type + " operation")
+	log.Debug("Discarding dequeued message")
+	qm.Delete()
+	forgetFailure(qm)
 }
 
+// Init runs the daemon until it receives SIGINT or SIGTERM. It then stops
+// dequeuing and waits for active transfers up to the drain timeout.
 func Init() {
-	messagesURL, azureContext := azure.GetMessagesURLAndContext()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	messageChannel := make(chan *azqueue.DequeuedMessage, constant.MaxConcurrentTransfers)
+	priorityLanes := newLanes()
+	_, azureContext := azure.GetMessagesURLAndContext(constant.PriorityNormal)
 
 	log := logger.Get().WithFields(logrus.Fields{
 		"event": "QueueOperation",
 	})
 
-	for i := 0; i < constant.MaxConcurrentTransfers; i++ {
-		// Go routine for handling messages
-		go func(messageChannel <-chan *azqueue.DequeuedMessage) {
-			for {
-				inboundMessage := <-messageChannel
-				popReceipt := inboundMessage.PopReceipt
-				URL := messagesURL.NewMessageIDURL(inboundMessage.ID)
-
-				queueMessage := &QueueMessage{
-					context:    azureContext,
-					text:       inboundMessage.Text,
-					popReceipt: popReceipt,
-					URL:        URL,
-				}
-
-				if inboundMessage.DequeueCount > constant.MaxRetriesThreshold {
-					URL.Delete(azureContext, popReceipt)
-					log.Warn(fmt.Sprintf("Deleted message with ID: %s as it reached the failure threshold %d", inboundMessage.ID, constant.MaxRetriesThreshold))
-					continue
-				}
-
-				handleMessage(queueMessage)
+	for _, warning := range config.Warnings() {
+		log.Warn(warning)
+	}
+
+	// Refresh the key revocation list in the background
+	go keys.WatchRevocations()
+
+	// Transfers that got no response in time are reported to exits
+	registry.OnExpire(func(transfer registry.Transfer) {
+		log.WithField("id", transfer.ID).Warn("Transfer expired without a response from " + transfer.Details.DestinationAgent)
+		exits.Notify(sendEvent(constant.ExitExpiry, transfer.ID, transfer.Details, ""))
+	})
+
+	// Apply configuration changes without dropping in-flight transfers
+	config.Watch(func(restart []string, err error) {
+		if err != nil {
+			log.Error("Rejected invalid configuration, keeping the running configuration", err)
+			return
+		}
+		for _, setting := range restart {
+			log.Warn(fmt.Sprintf("Changed setting %s takes effect after a restart", setting))
+		}
+		log.Info("Reloaded configuration")
+	})
+
+	// Send scheduled transfers until shutdown, letting runs in progress finish
+	scheduled := make(chan struct{})
+	go func() {
+		schedule.Run(ctx)
+		close(scheduled)
+	}()
+	defer func() { <-scheduled }()
+
+	// Send files dropped in watched directories until shutdown
+	watched := make(chan struct{})
+	go func() {
+		watch.Run(ctx)
+		close(watched)
+	}()
+	defer func() { <-watched }()
+
+	// Worker pools are sized at startup, a restart applies new sizes
+	messagePools := newPools(config.GetConfig().Daemon)
+
+	stopLeases := make(chan struct{})
+	defer close(stopLeases)
+	go keepWaitingLeases(stopLeases)
+
+	// Transfers are handed off by the control pool to the data pool
+	handOff := func(qm *QueueMessage, run func()) {
+		handedOff := messagePools.handOff(func() {
+			// Transfers that were waiting when shutdown began are left for another instance
+			if ctx.Err() != nil {
+				finishMessage(qm)
+				qm.Release()
+				return
 			}
-		}(messageChannel)
+			run()
+			finishMessage(qm)
+		})
+
+		// Transfers the data pool has no room for are tried again later
+		if !handedOff {
+			finishMessage(qm)
+			deferMessage(qm)
+		}
 	}
 
-	for {
-		// Try to dequeue a batch of messages from the queue
-		dequeue, err := messagesURL.Dequeue(azureContext, azqueue.QueueMaxMessagesDequeue, 60*time.Second)
+	workers := sync.WaitGroup{}
+	messagePools.start(&workers, func(messagePool *pool, queueMessage *QueueMessage) {
+		// Messages that were waiting when shutdown began are left for another instance
+		if ctx.Err() != nil {
+			queueMessage.Release()
+			return
+		}
+
+		// Messages whose last attempt did not finish, such as after a crash
+		settings := config.GetConfig().Daemon.ForType(peekMessageType(queueMessage.text))
+		if queueMessage.dequeueCount > int64(*settings.MaxRetries)+1 {
+			deadLetter(queueMessage)
+			return
+		}
+
+		// Dedicated pools run transfers themselves
+		poolHandOff := handOff
+		if messagePool != messagePools.control {
+			poolHandOff = nil
+		}
+
+		leaseContext := keepLease(queueMessage)
+		trackMessage(queueMessage)
+		if !handleMessage(leaseContext, queueMessage, poolHandOff) {
+			finishMessage(queueMessage)
+		}
+	})
+
+	poll := newPoller()
+	defer poll.stop()
+	go poll.heartbeat(ctx)
+
+	for ctx.Err() == nil {
+		// Only dequeue as many messages as there are workers free to take them
+		messagePools.wait(ctx)
+		free := messagePools.free()
+		if ctx.Err() != nil {
+			break
+		}
+		if free > azqueue.QueueMaxMessagesDequeue {
+			free = azqueue.QueueMaxMessagesDequeue
+		}
+
+		// Poll the lanes in weighted order and take messages from the first that has any
+		visibilityTimeout := config.GetConfig().Daemon.VisibilityTimeout
+		var dequeue *azqueue.DequeuedMessagesResponse
+		var from *lane
+		var err error
+		for _, from = range priorityLanes.order(config.GetConfig().Daemon.PriorityWeights) {
+			dequeue, err = from.messagesURL.Dequeue(ctx, int32(free), visibilityTimeout)
+			if err != nil || dequeue.NumMessages() > 0 {
+				break
+			}
+		}
 		if err != nil {
-			log.Fatal(err)
+			if ctx.Err() != nil {
+				break
+			}
+			sleep(ctx, poll.failure(err))
+			continue
 		}
+		wait := poll.success(dequeue.NumMessages() > 0)
 		if dequeue.NumMessages() == 0 {
-			time.Sleep(time.Second * 1)
-		} else {
-			log.Debug("Processing new messages")
+			sleep(ctx, wait)
+			continue
+		}
+
+		log.Debug("Processing new " + from.priority + " priority messages")
+
+		for m := int32(0); m < dequeue.NumMessages(); m++ {
+			inboundMessage := dequeue.Message(m)
+			settings := config.GetConfig().Daemon.ForType(peekMessageType(inboundMessage.Text))
+
+			queueMessage := &QueueMessage{
+				id:             inboundMessage.ID,
+				priority:       from.priority,
+				context:        azureContext,
+				text:           inboundMessage.Text,
+				popReceipt:     inboundMessage.PopReceipt,
+				URL:            from.messagesURL.NewMessageIDURL(inboundMessage.ID),
+				leaseExtension: settings.LeaseExtension,
+				leasedUntil:    time.Now().Add(visibilityTimeout),
+				lease:          visibilityTimeout,
+				dequeueCount:   inboundMessage.DequeueCount,
+				// The first dequeue is not a retry
+				lastAttempt: inboundMessage.DequeueCount > int64(*settings.MaxRetries),
+			}
 
-			for m := int32(0); m < dequeue.NumMessages(); m++ {
-				messageChannel <- dequeue.Message(m)
+			// The message may wait for a worker of its pool, its lease is kept until one takes it
+			if !messagePools.dispatch(queueMessage) {
+				deferMessage(queueMessage)
 			}
 		}
 	}
+
+	messagePools.close()
+
+	drainTimeout := config.GetConfig().Daemon.DrainTimeout
+	log.Info(fmt.Sprintf("Stopped dequeuing messages, waiting up to %s for active transfers to finish", drainTimeout))
+
+	drained := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Info("All active transfers finished")
+	case <-time.After(drainTimeout):
+		released := releaseInFlight()
+		log.Warn(fmt.Sprintf("Drain timeout reached, released %d unfinished messages to the queue", released))
+	}
+
+	// Exits of the transfers that finished are given the drain timeout to run
+	if !exits.Wait(drainTimeout) {
+		log.Warn("Drain timeout reached before every exit ran")
+	}
 }
@@ -2,6 +2,7 @@ package daemon
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-storage-queue-go/azqueue"
@@ -9,24 +10,89 @@ import (
 )
 
 type QueueMessage struct {
+	id azqueue.MessageID
+	// priority is the lane the message was dequeued from, replies are sent on the same lane
+	priority   string
 	context    context.Context
 	text       string
 	popReceipt azqueue.PopReceipt
 	URL        azqueue.MessageIDURL
+	lock       sync.Mutex
+
+	// leaseExtension is how long each renewal by the lease keeper hides the message for
+	leaseExtension time.Duration
+	// stopLease stops the lease keeper of the message
+	stopLease context.CancelFunc
+
+	// leasedUntil is when the message becomes visible again unless its lease
+	// is renewed, and lease is how long it was last hidden for
+	leasedUntil time.Time
+	lease       time.Duration
+
+	dequeueCount int64
+	// lastAttempt is set when a failure moves the message to the dead-letter queue
+	lastAttempt bool
 }
 
 func (qm *QueueMessage) Delete() {
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+
 	_, err := qm.URL.Delete(qm.context, qm.popReceipt)
 	if err != nil {
 		logger.Get().Trace(err)
 	}
 }
 
-func (qm *QueueMessage) IncreaseLease() {
-	log := logger.Get()
-	update, err := qm.URL.Update(qm.context, qm.popReceipt, time.Second*120, qm.text)
+// extendLease hides the message for d from now
+func (qm *QueueMessage) extendLease(d time.Duration) error {
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+
+	update, err := qm.URL.Update(qm.context, qm.popReceipt, d, qm.text)
+	if err != nil {
+		logger.Get().Debug("Failed to increase lease", err)
+		return err
+	}
+	qm.popReceipt = update.PopReceipt
+	qm.leasedUntil = time.Now().Add(d)
+	qm.lease = d
+	return nil
+}
+
+// endLease stops the lease keeper of the message, if it has one
+func (qm *QueueMessage) endLease() {
+	qm.lock.Lock()
+	stopLease := qm.stopLease
+	qm.lock.Unlock()
+
+	if stopLease != nil {
+		stopLease()
+	}
+}
+
+// leaseExpiring reports whether less than half of the last lease remains
+func (qm *QueueMessage) leaseExpiring(now time.Time) bool {
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+
+	return qm.leasedUntil.Sub(now) < qm.lease/2
+}
+
+// Release makes the message visible again straight away so that another
+// instance can pick it up
+func (qm *QueueMessage) Release() {
+	qm.releaseAfter(0)
+}
+
+// releaseAfter makes the message visible again after d
+func (qm *QueueMessage) releaseAfter(d time.Duration) {
+	qm.lock.Lock()
+	defer qm.lock.Unlock()
+
+	update, err := qm.URL.Update(qm.context, qm.popReceipt, d, qm.text)
 	if err != nil {
-		log.Debug("Failed to increase lease", err)
+		logger.Get().Debug("Failed to release message", err)
 	} else {
 		qm.popReceipt = update.PopReceipt
 	}
@@ -0,0 +1,167 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/health"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+// jitter is only used by the dequeue loop. It is seeded so that agents
+// started together do not draw the same waits.
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// backoff doubles a wait from min up to max on each step
+type backoff struct {
+	attempt int
+}
+
+// next returns the next wait with jitter, between half of and the full
+// exponential value, so that agents do not retry in step with each other
+func (b *backoff) next(min time.Duration, max time.Duration) time.Duration {
+	wait := max
+	if b.attempt < 32 && min<<b.attempt < max {
+		wait = min << b.attempt
+		b.attempt++
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(jitter.Int63n(int64(wait/2)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// poller paces the dequeue loop. Empty polls slow down from the minimum to
+// the maximum poll interval, failed polls back off exponentially, and once
+// too many polls fail in a row the circuit opens and the daemon reports
+// degraded health until a poll succeeds again. Settings are read on every
+// poll so that they follow configuration reloads.
+type poller struct {
+	idle   backoff
+	errors backoff
+	log    *logrus.Entry
+
+	// lock guards status, which the heartbeat writes while the loop polls
+	lock   sync.Mutex
+	status health.Status
+}
+
+func newPoller() *poller {
+	p := &poller{
+		log: logger.Get().WithFields(logrus.Fields{
+			"event": "QueuePoll",
+		}),
+	}
+	p.setStatus(constant.HealthStatusHealthy, "")
+	return p
+}
+
+func (p *poller) setStatus(status string, lastError string) {
+	if status != p.status.Status {
+		p.status.Status = status
+		p.status.Since = time.Now().Unix()
+	}
+	p.status.LastError = lastError
+	p.writeHealth()
+}
+
+func (p *poller) writeHealth() {
+	if err := health.Write(p.status); err != nil {
+		p.log.Warn("Failed to write health file", err)
+	}
+}
+
+// heartbeat refreshes the health file until ctx is done so that a daemon that
+// stopped is noticed. It runs on its own, as the dequeue loop waits while all
+// workers are busy.
+func (p *poller) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(constant.HealthHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.lock.Lock()
+			p.writeHealth()
+			p.lock.Unlock()
+		}
+	}
+}
+
+// failure records a failed poll and returns how long to wait before the next
+func (p *poller) failure(err error) time.Duration {
+	settings := config.GetConfig().Daemon
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.status.ConsecutiveFailures++
+	p.idle.reset()
+	wait := p.errors.next(constant.BackoffBase, settings.BackoffMax)
+
+	if p.status.ConsecutiveFailures == settings.FailureThreshold {
+		p.log.Error(fmt.Sprintf("Queue unreachable after %d attempts, reporting degraded health", p.status.ConsecutiveFailures), err)
+		p.setStatus(constant.HealthStatusDegraded, err.Error())
+	} else {
+		p.log.Warn(fmt.Sprintf("Failed to dequeue messages, retrying in %s", wait.Round(time.Millisecond)), err)
+		if p.status.Status == constant.HealthStatusDegraded {
+			p.status.LastError = err.Error()
+		}
+	}
+	return wait
+}
+
+// success records a poll that reached the queue and returns how long to wait
+// before the next, which is immediately when messages were received
+func (p *poller) success(received bool) time.Duration {
+	settings := config.GetConfig().Daemon
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.status.ConsecutiveFailures > 0 {
+		if p.status.Status == constant.HealthStatusDegraded {
+			p.log.Info(fmt.Sprintf("Queue reachable again after %d failed attempts", p.status.ConsecutiveFailures))
+		}
+		p.status.ConsecutiveFailures = 0
+		p.errors.reset()
+		p.setStatus(constant.HealthStatusHealthy, "")
+	}
+
+	if received {
+		p.idle.reset()
+		return 0
+	}
+	return p.idle.next(settings.PollIntervalMin, settings.PollIntervalMax)
+}
+
+// stop reports that the daemon is no longer polling
+func (p *poller) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.setStatus(constant.HealthStatusStopped, "")
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,249 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/willhackett/azure-mft/pkg/azure"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+// pool is a set of workers taking messages from a channel
+type pool struct {
+	messages chan *QueueMessage
+	workers  int
+	slots    *capacity
+}
+
+// dataPool runs the uploads and downloads handed off by the control pool.
+// Up to its backlog of transfers wait for a free worker, their leases kept
+// by the lease keeper started when handling began. Transfers beyond that are
+// released for later.
+type dataPool struct {
+	transfers chan func()
+	workers   int
+	slots     *capacity
+}
+
+// pools splits the work of the daemon. The control pool verifies every
+// message and handles requests and handshakes itself, so that they are never
+// stuck behind a long transfer. Message types may be given dedicated pools
+// which handle them entirely.
+type pools struct {
+	control   *pool
+	data      *dataPool
+	dedicated map[string]*pool
+
+	// freed is signalled whenever a slot of any pool is given back
+	freed chan struct{}
+}
+
+// newPools sizes the pools from the configuration. Channels are buffered for
+// the full capacity of their pool so that dispatching never blocks.
+func newPools(daemon config.DaemonConf) *pools {
+	p := &pools{
+		dedicated: map[string]*pool{},
+		freed:     make(chan struct{}, 1),
+	}
+
+	newPool := func(workers int) *pool {
+		return &pool{
+			messages: make(chan *QueueMessage, workers),
+			workers:  workers,
+			slots:    &capacity{size: workers, freed: p.freed},
+		}
+	}
+
+	p.control = newPool(daemon.ControlWorkers)
+	for messageType, settings := range daemon.MessageTypes {
+		if settings.Workers > 0 {
+			p.dedicated[messageType] = newPool(settings.Workers)
+		}
+	}
+
+	dataSize := daemon.Workers + *daemon.DataBacklog
+	p.data = &dataPool{
+		transfers: make(chan func(), dataSize),
+		workers:   daemon.Workers,
+		slots:     &capacity{size: dataSize, freed: p.freed},
+	}
+	return p
+}
+
+// peekMessageType reads the type of a message before its signature has been
+// verified. It is only used to pick a pool and settings, handleMessage
+// verifies the message before acting on it.
+func peekMessageType(text string) string {
+	message := struct {
+		Type string `json:"type"`
+	}{}
+	json.Unmarshal([]byte(text), &message)
+	return message.Type
+}
+
+// route returns the pool for a message
+func (p *pools) route(qm *QueueMessage) *pool {
+	if dedicated, ok := p.dedicated[strings.ToLower(peekMessageType(qm.text))]; ok {
+		return dedicated
+	}
+	return p.control
+}
+
+// dispatch queues a message for its pool, keeping its lease until a worker
+// takes it. It reports false, without queueing, when the pool is full.
+func (p *pools) dispatch(qm *QueueMessage) bool {
+	target := p.route(qm)
+	if !target.slots.tryTake() {
+		return false
+	}
+	holdMessage(qm)
+	target.messages <- qm
+	return true
+}
+
+// handOff queues the upload or download of a message for the data pool. It
+// does not block, it reports false when the data pool and its backlog are
+// full.
+func (p *pools) handOff(run func()) bool {
+	if !p.data.slots.tryTake() {
+		return false
+	}
+	p.data.transfers <- run
+	return true
+}
+
+// free returns how many messages can be dequeued. Only the control pool is
+// counted, so that requests and handshakes are still dequeued while the data
+// pool or a dedicated pool is full; messages for a full pool are deferred.
+func (p *pools) free() int {
+	return p.control.slots.free()
+}
+
+// deferMessage puts a message its pool has no room for back on its queue as
+// a new message, hidden for a while so that it is not dequeued again straight
+// away. Releasing it instead would count as a delivery towards its retries.
+func deferMessage(qm *QueueMessage) {
+	settings := config.GetConfig().Daemon.ForType(peekMessageType(qm.text))
+	queueName := azure.PriorityQueueName(config.GetConfig().Agent.Name, qm.priority)
+
+	if err := azure.PostDelayedMessage(queueName, qm.text, constant.PoolFullDelay, settings.MessageTTL); err != nil {
+		logger.Get().WithField("queue_message_id", qm.id).Warn("Failed to defer message, releasing it", err)
+		qm.releaseAfter(constant.PoolFullDelay)
+		return
+	}
+	qm.Delete()
+	forgetFailure(qm)
+}
+
+// wait blocks until a message can be dequeued or ctx is done
+func (p *pools) wait(ctx context.Context) {
+	for p.free() <= 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.freed:
+		}
+	}
+}
+
+// close stops the pools taking messages. The data pool is closed by start
+// once the control pool can no longer hand off transfers.
+func (p *pools) close() {
+	close(p.control.messages)
+	for _, dedicated := range p.dedicated {
+		close(dedicated.messages)
+	}
+}
+
+// start runs the workers of every pool. Message workers handle messages with
+// worker, which is given the pool the message came from, and data workers
+// run the transfers handed off to them.
+func (p *pools) start(workers *sync.WaitGroup, worker func(*pool, *QueueMessage)) {
+	messageWorkers := sync.WaitGroup{}
+
+	for _, messagePool := range append([]*pool{p.control}, p.dedicatedPools()...) {
+		for i := 0; i < messagePool.workers; i++ {
+			messageWorkers.Add(1)
+
+			go func(messagePool *pool) {
+				defer messageWorkers.Done()
+				for qm := range messagePool.messages {
+					unholdMessage(qm)
+					worker(messagePool, qm)
+					messagePool.slots.put()
+				}
+			}(messagePool)
+		}
+	}
+
+	for i := 0; i < p.data.workers; i++ {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+			for run := range p.data.transfers {
+				run()
+				p.data.slots.put()
+			}
+		}()
+	}
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		messageWorkers.Wait()
+		close(p.data.transfers)
+	}()
+}
+
+func (p *pools) dedicatedPools() []*pool {
+	dedicated := []*pool{}
+	for _, messagePool := range p.dedicated {
+		dedicated = append(dedicated, messagePool)
+	}
+	return dedicated
+}
+
+// capacity counts the messages held by a pool against its size
+type capacity struct {
+	sync.Mutex
+	size  int
+	held  int
+	freed chan struct{}
+}
+
+// free returns how many more messages can be held
+func (c *capacity) free() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.size - c.held
+}
+
+// tryTake holds a message if there is room for it
+func (c *capacity) tryTake() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.held >= c.size {
+		return false
+	}
+	c.held++
+	return true
+}
+
+// put gives back the slot of a message that has been dealt with
+func (c *capacity) put() {
+	c.Lock()
+	c.held--
+	c.Unlock()
+
+	select {
+	case c.freed <- struct{}{}:
+	default:
+	}
+}
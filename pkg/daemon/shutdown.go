@@ -0,0 +1,45 @@
+package daemon
+
+import (
+	"sync"
+)
+
+// inFlight holds the messages being handled so that they can be released if
+// they do not finish before the drain timeout
+var inFlight = struct {
+	sync.Mutex
+	messages map[*QueueMessage]bool
+}{messages: map[*QueueMessage]bool{}}
+
+func trackMessage(qm *QueueMessage) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	inFlight.messages[qm] = true
+}
+
+func untrackMessage(qm *QueueMessage) {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	delete(inFlight.messages, qm)
+}
+
+// finishMessage stops keeping the lease of a message that has been dealt with
+func finishMessage(qm *QueueMessage) {
+	qm.endLease()
+	untrackMessage(qm)
+}
+
+// releaseInFlight makes every unfinished message visible again and returns
+// how many were released
+func releaseInFlight() int {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	for qm := range inFlight.messages {
+		qm.endLease()
+		qm.Release()
+	}
+	return len(inFlight.messages)
+}
@@ -0,0 +1,37 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+// disposeSource does what the request asked with a file once its delivery
+// has been confirmed. A file moved or renamed onto one of the same name is
+// given the transfer ID as a suffix rather than replacing it.
+func disposeSource(id string, details constant.FileRequestMessage) error {
+	if details.SourceAction == nil {
+		return nil
+	}
+
+	var target string
+	switch details.SourceAction.Action {
+	case constant.SourceActionDelete:
+		return os.Remove(details.FileName)
+	case constant.SourceActionMove:
+		if err := os.MkdirAll(details.SourceAction.MoveTo, 0755); err != nil {
+			return err
+		}
+		target = filepath.Join(details.SourceAction.MoveTo, filepath.Base(details.FileName))
+	case constant.SourceActionRename:
+		target = details.FileName + details.SourceAction.RenameSuffix
+	default:
+		return nil
+	}
+
+	if _, err := os.Lstat(target); err == nil {
+		target += "." + id
+	}
+	return os.Rename(details.FileName, target)
+}
@@ -0,0 +1,209 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Azure/azure-storage-queue-go/azqueue"
+	"github.com/willhackett/azure-mft/pkg/azure"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+// scanVisibilityTimeout hides dead letters while they are being scanned
+const scanVisibilityTimeout = time.Second * 30
+
+// ErrNotFound is returned when no dead letter has the given ID
+var ErrNotFound = errors.New("dead letter not found")
+
+// Entry is a dead letter as it is stored on the dead-letter queue
+type Entry struct {
+	ID            string    `json:"id"`
+	InsertionTime time.Time `json:"insertion_time"`
+	constant.DeadLetterMessage
+}
+
+// Send adds a message that could not be processed to the dead-letter queue.
+// Dead letters do not expire, they stay until they are replayed or purged.
+func Send(message constant.DeadLetterMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return azure.PostMessage(azure.DeadLetterQueueName(config.GetConfig().Agent.Name), string(body), -time.Second)
+}
+
+func toEntry(id azqueue.MessageID, insertionTime time.Time, text string) Entry {
+	entry := Entry{
+		ID:            string(id),
+		InsertionTime: insertionTime,
+	}
+	if err := json.Unmarshal([]byte(text), &entry.DeadLetterMessage); err != nil {
+		entry.LastError = "dead letter cannot be read: " + err.Error()
+		entry.Message = text
+	}
+	return entry
+}
+
+// scan visits the dead letters until visit stops it. Queues cannot be read by
+// message ID, so the messages are dequeued and briefly hidden; those that visit
+// does not consume are made visible again once the scan is done. The scan ends
+// once it has dequeued as many messages as the queue held when it started, or
+// when a message comes round again because its visibility timeout ran out.
+func scan(visit func(messageURL azqueue.MessageIDURL, message *azqueue.DequeuedMessage) (consumed bool, stop bool, err error)) error {
+	messagesURL, ctx := azure.GetDeadLetterMessagesURLAndContext()
+
+	// The count is approximate, a small queue is read until it is empty
+	count, err := azure.CountDeadLetters()
+	if err != nil {
+		return err
+	}
+	if count < azqueue.QueueMaxMessagesDequeue {
+		count = azqueue.QueueMaxMessagesDequeue
+	}
+
+	// Only the latest pop receipt of a message can make it visible again
+	visited := map[azqueue.MessageID]*azqueue.DequeuedMessage{}
+	defer func() {
+		for _, message := range visited {
+			messagesURL.NewMessageIDURL(message.ID).Update(ctx, message.PopReceipt, 0, message.Text)
+		}
+	}()
+
+	seen := 0
+	for seen < count {
+		dequeue, err := messagesURL.Dequeue(ctx, azqueue.QueueMaxMessagesDequeue, scanVisibilityTimeout)
+		if err != nil {
+			return err
+		}
+		if dequeue.NumMessages() == 0 {
+			return nil
+		}
+
+		repeated := false
+		for m := int32(0); m < dequeue.NumMessages(); m++ {
+			message := dequeue.Message(m)
+			if _, ok := visited[message.ID]; ok {
+				repeated = true
+				visited[message.ID] = message
+				continue
+			}
+			seen++
+
+			consumed, stop, err := visit(messagesURL.NewMessageIDURL(message.ID), message)
+			if !consumed {
+				visited[message.ID] = message
+			}
+			if err != nil || stop {
+				return err
+			}
+		}
+		if repeated {
+			return nil
+		}
+	}
+	return nil
+}
+
+// List returns the dead letters at the front of the queue, up to 32, and the
+// approximate number of dead letters on the queue. They are peeked so that
+// listing does not hide them from a replay or another list.
+func List() ([]Entry, int, error) {
+	messagesURL, ctx := azure.GetDeadLetterMessagesURLAndContext()
+
+	peek, err := messagesURL.Peek(ctx, azqueue.QueueMaxMessagesPeek)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := []Entry{}
+	for m := int32(0); m < peek.NumMessages(); m++ {
+		message := peek.Message(m)
+		entries = append(entries, toEntry(message.ID, message.InsertionTime, message.Text))
+	}
+
+	count, err := azure.CountDeadLetters()
+	if err != nil {
+		return nil, 0, err
+	}
+	if count < len(entries) {
+		count = len(entries)
+	}
+	return entries, count, nil
+}
+
+// Get returns a single dead letter. Dead letters beyond the front of the
+// queue are looked up the way Replay finds them.
+func Get(id string) (Entry, error) {
+	entries, _, err := List()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	for _, entry := range entries {
+		if entry.ID == id {
+			return entry, nil
+		}
+	}
+
+	var found *Entry
+	err = scan(func(messageURL azqueue.MessageIDURL, message *azqueue.DequeuedMessage) (bool, bool, error) {
+		if string(message.ID) != id {
+			return false, false, nil
+		}
+		entry := toEntry(message.ID, message.InsertionTime, message.Text)
+		found = &entry
+		return false, true, nil
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+	if found == nil {
+		return Entry{}, ErrNotFound
+	}
+	return *found, nil
+}
+
+// Replay puts the original message of a dead letter back on the queue of the
+// agent for its priority and removes the dead letter
+func Replay(id string) error {
+	_, ctx := azure.GetDeadLetterMessagesURLAndContext()
+	found := false
+
+	err := scan(func(messageURL azqueue.MessageIDURL, message *azqueue.DequeuedMessage) (bool, bool, error) {
+		if string(message.ID) != id {
+			return false, false, nil
+		}
+		found = true
+
+		entry := toEntry(message.ID, message.InsertionTime, message.Text)
+		if entry.Message == "" {
+			return false, true, errors.New("dead letter holds no message")
+		}
+
+		ttl := config.GetConfig().Daemon.ForType(entry.Type).MessageTTL
+		if err := azure.PostMessage(azure.PriorityQueueName(config.GetConfig().Agent.Name, entry.Priority), entry.Message, ttl); err != nil {
+			return false, true, err
+		}
+
+		_, err := messageURL.Delete(ctx, message.PopReceipt)
+		return true, true, err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Purge removes every dead letter
+func Purge() error {
+	messagesURL, ctx := azure.GetDeadLetterMessagesURLAndContext()
+
+	_, err := messagesURL.Clear(ctx)
+	return err
+}
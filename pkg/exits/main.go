@@ -0,0 +1,239 @@
+package exits
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+// maxOutput bounds the output of an exit kept in the log
+const maxOutput = 4096
+
+// exitWaitDelay is how long the output of an exit is read for once it has
+// been killed or has exited
+const exitWaitDelay = time.Second * 5
+
+var log = logger.Get().WithFields(logrus.Fields{
+	"event": "Exit",
+})
+
+var (
+	// notifications holds the events waiting for a notification worker
+	notifications = make(chan Event, constant.ExitQueueSize)
+	startWorkers  sync.Once
+	pending       sync.WaitGroup
+)
+
+// Event describes what happened to a transfer. It is written as JSON to the
+// standard input of every exit that runs for it.
+type Event struct {
+	Event          string    `json:"event"`
+	Direction      string    `json:"direction"`
+	TransferID     string    `json:"transfer_id"`
+	Agent          string    `json:"agent"`
+	LocalAgent     string    `json:"local_agent"`
+	FileName       string    `json:"file_name,omitempty"`
+	RemoteFileName string    `json:"remote_file_name,omitempty"`
+	FileSize       int64     `json:"file_size,omitempty"`
+	Priority       string    `json:"priority,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+// matches reports whether an exit runs for an event
+func matches(exit config.Exit, event Event) bool {
+	if exit.Event != event.Event {
+		return false
+	}
+	if exit.Direction != "" && exit.Direction != event.Direction {
+		return false
+	}
+	if exit.AgentName != "" && exit.AgentName != event.Agent {
+		return false
+	}
+	if exit.FileMatch != "" {
+		matched, err := regexp.MatchString(exit.FileMatch, event.FileName)
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Wanted reports whether any exit is configured for an event, so that work
+// only needed by exits can be skipped
+func Wanted(eventName string) bool {
+	for _, exit := range config.GetConfig().Exits {
+		if exit.Event == eventName {
+			return true
+		}
+	}
+	return false
+}
+
+// arguments splits the command of an exit and fills in the placeholders of
+// each argument, so that values with spaces stay one argument and are never
+// interpreted by a shell
+func arguments(exit config.Exit, event Event) ([]string, error) {
+	args, err := constant.SplitCommand(exit.Command)
+	if err != nil {
+		return nil, err
+	}
+
+	replacer := strings.NewReplacer(
+		"{fullFilePath}", event.FileName,
+		"{fileName}", filepath.Base(event.FileName),
+		"{remoteFilePath}", event.RemoteFileName,
+		"{agent}", event.Agent,
+		"{transferId}", event.TransferID,
+		"{event}", event.Event,
+		"{direction}", event.Direction,
+		"{reason}", event.Reason,
+	)
+	for i := range args {
+		args[i] = replacer.Replace(args[i])
+	}
+	return args, nil
+}
+
+// run runs an exit with the event on its standard input
+func run(exit config.Exit, event Event) error {
+	args, err := arguments(exit, event)
+	if err != nil {
+		return err
+	}
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exit.Timeout)
+	defer cancel()
+
+	output := bytes.Buffer{}
+	command := exec.CommandContext(ctx, args[0], args[1:]...)
+	command.Stdin = bytes.NewReader(eventBytes)
+	command.Stdout = &output
+	command.Stderr = &output
+	// Children of a killed exit may hold its output open, stop waiting for them
+	command.WaitDelay = exitWaitDelay
+
+	err = command.Run()
+	out := strings.TrimSpace(output.String())
+	if len(out) > maxOutput {
+		out = out[len(out)-maxOutput:]
+	}
+
+	log := log.WithFields(logrus.Fields{
+		"id":      event.TransferID,
+		"exit":    event.Event,
+		"command": args[0],
+	})
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s did not finish within %s", args[0], exit.Timeout)
+	}
+	if err != nil {
+		if out != "" {
+			return fmt.Errorf("%s: %v: %s", args[0], err, out)
+		}
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	log.WithField("output", out).Debug("Exit finished")
+	return nil
+}
+
+// complete fills in what every event carries
+func complete(event *Event) {
+	event.LocalAgent = config.GetConfig().Agent.Name
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+}
+
+// Notify queues an event for the exits matching it, which run in turn on a
+// notification worker so that a slow exit does not hold up the handler. An
+// event is dropped, and logged, when the queue is full.
+func Notify(event Event) {
+	if !Wanted(event.Event) {
+		return
+	}
+	complete(&event)
+
+	startWorkers.Do(func() {
+		for i := 0; i < constant.ExitWorkers; i++ {
+			go func() {
+				for event := range notifications {
+					notify(event)
+					pending.Done()
+				}
+			}()
+		}
+	})
+
+	pending.Add(1)
+	select {
+	case notifications <- event:
+	default:
+		pending.Done()
+		log.WithField("id", event.TransferID).Warn(fmt.Sprintf("Too many exits waiting to run, exits for %s skipped", event.Event))
+	}
+}
+
+// Wait waits up to timeout for the queued notifications to run and reports
+// whether they all did
+func Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// notify runs the exits matching an event in turn, logging those that fail
+func notify(event Event) {
+	for _, exit := range config.GetConfig().Exits {
+		if !matches(exit, event) {
+			continue
+		}
+		if err := run(exit, event); err != nil {
+			log.WithField("id", event.TransferID).Error(fmt.Sprintf("Exit for %s failed", event.Event), err)
+		}
+	}
+}
+
+// Allow runs the exits matching an event in turn, each within its timeout,
+// and returns the error of the first that fails, which vetoes the transfer.
+// Unlike Notify it waits for them.
+func Allow(event Event) error {
+	complete(&event)
+
+	for _, exit := range config.GetConfig().Exits {
+		if !matches(exit, event) {
+			continue
+		}
+		if err := run(exit, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
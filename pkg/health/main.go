@@ -0,0 +1,75 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+const (
+	healthFileName = "health.json"
+)
+
+// Status is the health of the daemon as written to the health file
+type Status struct {
+	Status              string `json:"status"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+	Since               int64  `json:"since"`
+	UpdatedAt           int64  `json:"updated_at"`
+}
+
+func healthFile() string {
+	return filepath.Join(config.GetConfig().Paths.CacheDir, healthFileName)
+}
+
+// Write replaces the health file. The file is renamed into place so that
+// readers never see a partial write.
+func Write(status Status) error {
+	status.UpdatedAt = time.Now().Unix()
+
+	statusBytes, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.GetConfig().Paths.CacheDir, 0700); err != nil {
+		return err
+	}
+
+	tmpFile := healthFile() + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, statusBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, healthFile())
+}
+
+// Read returns the health last written by the daemon
+func Read() (Status, error) {
+	status := Status{}
+
+	statusBytes, err := ioutil.ReadFile(healthFile())
+	if err != nil {
+		return status, err
+	}
+	err = json.Unmarshal(statusBytes, &status)
+	return status, err
+}
+
+// Check returns an error unless the daemon is healthy and has written its
+// health file recently
+func Check(status Status, now time.Time) error {
+	updatedAt := time.Unix(status.UpdatedAt, 0)
+	if now.Sub(updatedAt) > constant.HealthStaleAfter {
+		return fmt.Errorf("daemon has not reported its health since %s", updatedAt.UTC().Format(time.RFC3339))
+	}
+	if status.Status != constant.HealthStatusHealthy {
+		return fmt.Errorf("daemon is %s", status.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	agentTimeout = 10 * time.Second
+)
+
+// agentRequest is written to the signing agent as a single line of JSON
+type agentRequest struct {
+	Op   string `json:"op"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// agentResponse is read from the signing agent as a single line of JSON
+type agentResponse struct {
+	Result []byte `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// agentProvider delegates signing and decryption to a local signing agent
+// listening on a Unix socket. The agent may keep its keys in a vault or HSM.
+//
+// Each operation opens a connection and sends one request:
+//
+//	{"op": "public_key"}          result is the PEM encoded public key
+//	{"op": "sign", "data": ...}    result is the signature of data
+//	{"op": "decrypt", "data": ...} result is the plaintext of data
+//
+// Binary values are base64 encoded and errors are reported in "error".
+type agentProvider struct {
+	socket    string
+	keyID     string
+	publicKey *PublicKey
+}
+
+func newAgentProvider(socket string) (*agentProvider, error) {
+	p := &agentProvider{socket: socket}
+
+	publicKeyBytes, err := p.call("public_key", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p.publicKey, err = parsePublicKey(publicKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	p.keyID, err = generatePublicKeyID(p.publicKey.Signing)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *agentProvider) call(op string, data []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", p.socket, agentTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(agentTimeout)); err != nil {
+		return nil, err
+	}
+
+	if err := json.NewEncoder(conn).Encode(agentRequest{Op: op, Data: data}); err != nil {
+		return nil, err
+	}
+
+	response := agentResponse{}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, errors.New("signing agent: " + response.Error)
+	}
+	return response.Result, nil
+}
+
+func (p *agentProvider) Sign(body []byte) ([]byte, error) {
+	return p.call("sign", body)
+}
+
+func (p *agentProvider) Decrypt(ciphertext []byte) ([]byte, error) {
+	return p.call("decrypt", ciphertext)
+}
+
+func (p *agentProvider) PublicKey() *PublicKey {
+	return p.publicKey
+}
+
+func (p *agentProvider) KeyID() string {
+	return p.keyID
+}
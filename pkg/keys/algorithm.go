@@ -0,0 +1,212 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+// PublicKey is the published identity of an agent. Signing verifies message
+// signatures and Encryption wraps secrets sent to the agent. Certificates
+// optionally chain the signing key to an organisational CA and Approvals hold
+// administrator countersignatures.
+type PublicKey struct {
+	Algorithm    string
+	Signing      crypto.PublicKey
+	Encryption   crypto.PublicKey
+	Certificates []*x509.Certificate
+	Approvals    []*pem.Block
+}
+
+// generateKeys creates a signing key and the key used to unwrap secrets. RSA
+// keys do both, elliptic curve algorithms get a separate ECDH key.
+func generateKeys(algorithm string) (crypto.Signer, crypto.PrivateKey, error) {
+	switch algorithm {
+	case constant.KeyAlgorithmRSA, constant.KeyAlgorithmRSAPSS:
+		privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, privateKey, nil
+	case constant.KeyAlgorithmEd25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		encryptionKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, encryptionKey, nil
+	case constant.KeyAlgorithmECDSAP256:
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		encryptionKey, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, encryptionKey, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported key algorithm '%s'", algorithm)
+}
+
+// keyMatchesAlgorithm reports whether a public key can be used with algorithm
+func keyMatchesAlgorithm(algorithm string, publicKey crypto.PublicKey) bool {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		return algorithm == constant.KeyAlgorithmRSA || algorithm == constant.KeyAlgorithmRSAPSS
+	case ed25519.PublicKey:
+		return algorithm == constant.KeyAlgorithmEd25519
+	case *ecdsa.PublicKey:
+		return algorithm == constant.KeyAlgorithmECDSAP256 && k.Curve == elliptic.P256()
+	}
+	return false
+}
+
+// toECDH converts an encryption key parsed from PKIX or PKCS#8 to ECDH form
+func toECDH(key interface{}) (interface{}, error) {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return k.ECDH()
+	case *ecdsa.PrivateKey:
+		return k.ECDH()
+	case *ecdh.PublicKey, *ecdh.PrivateKey:
+		return k, nil
+	}
+	return nil, errors.New("encryption key is not an ECDH key")
+}
+
+func signerOpts(algorithm string) crypto.SignerOpts {
+	switch algorithm {
+	case constant.KeyAlgorithmRSAPSS:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	case constant.KeyAlgorithmEd25519:
+		return crypto.Hash(0)
+	}
+	return crypto.SHA256
+}
+
+// sign signs body with the signer. Ed25519 signs the body itself, the other
+// algorithms sign its SHA-256 digest.
+func sign(algorithm string, signer crypto.Signer, body []byte) ([]byte, error) {
+	opts := signerOpts(algorithm)
+	if opts.HashFunc() == crypto.Hash(0) {
+		return signer.Sign(rand.Reader, body, opts)
+	}
+
+	hash := sha256.Sum256(body)
+	return signer.Sign(rand.Reader, hash[:], opts)
+}
+
+// verify checks a signature using the algorithm declared by the public key
+func verify(publicKey *PublicKey, body []byte, signature []byte) error {
+	hash := sha256.Sum256(body)
+
+	switch publicKey.Algorithm {
+	case constant.KeyAlgorithmRSA:
+		return rsa.VerifyPKCS1v15(publicKey.Signing.(*rsa.PublicKey), crypto.SHA256, hash[:], signature)
+	case constant.KeyAlgorithmRSAPSS:
+		return rsa.VerifyPSS(publicKey.Signing.(*rsa.PublicKey), crypto.SHA256, hash[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case constant.KeyAlgorithmEd25519:
+		if !ed25519.Verify(publicKey.Signing.(ed25519.PublicKey), body, signature) {
+			return errors.New("ed25519: invalid signature")
+		}
+		return nil
+	case constant.KeyAlgorithmECDSAP256:
+		if !ecdsa.VerifyASN1(publicKey.Signing.(*ecdsa.PublicKey), hash[:], signature) {
+			return errors.New("ecdsa: invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key algorithm '%s'", publicKey.Algorithm)
+}
+
+// deriveWrappingKey derives an AES-256 key from an ECDH shared secret bound to
+// both public keys of the exchange
+func deriveWrappingKey(shared []byte, ephemeral []byte, recipient []byte) []byte {
+	hash := sha256.New()
+	hash.Write(shared)
+	hash.Write(ephemeral)
+	hash.Write(recipient)
+	return hash.Sum(nil)
+}
+
+// wrapECDH encrypts plaintext to the recipient with an ephemeral ECDH key and
+// AES-GCM. The output is the ephemeral public key, the nonce and the sealed
+// plaintext.
+func wrapECDH(recipient *ecdh.PublicKey, plaintext []byte) ([]byte, error) {
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralBytes := ephemeral.PublicKey().Bytes()
+	gcm, err := newGCM(deriveWrappingKey(shared, ephemeralBytes, recipient.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext := append(ephemeralBytes, nonce...)
+	return gcm.Seal(ciphertext, nonce, plaintext, nil), nil
+}
+
+// unwrapECDH reverses wrapECDH with the private key of this agent
+func unwrapECDH(privateKey *ecdh.PrivateKey, ciphertext []byte) ([]byte, error) {
+	recipientBytes := privateKey.PublicKey().Bytes()
+	keySize := len(recipientBytes)
+	if len(ciphertext) < keySize {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	ephemeral, err := privateKey.Curve().NewPublicKey(ciphertext[:keySize])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := privateKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(deriveWrappingKey(shared, ciphertext[:keySize], recipientBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext = ciphertext[keySize:]
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
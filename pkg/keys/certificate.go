@@ -0,0 +1,170 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+const (
+	certificateExpiryWarning = 30 * 24 * time.Hour
+)
+
+// loadCertificates reads a PEM file holding a certificate followed by its
+// intermediates
+func loadCertificates(fileName string) ([]*x509.Certificate, error) {
+	certificatePem, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	certificates := []*x509.Certificate{}
+	for block, rest := pem.Decode(certificatePem); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", fileName)
+	}
+	return certificates, nil
+}
+
+func marshalCertificates(certificates []*x509.Certificate) []byte {
+	encoded := []byte{}
+	for _, certificate := range certificates {
+		encoded = append(encoded, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: certificate.Raw,
+		})...)
+	}
+	return encoded
+}
+
+func certificateMatchesKey(certificate *x509.Certificate, publicKey crypto.PublicKey) bool {
+	key, ok := certificate.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(publicKey)
+}
+
+func certificateNamesAgent(certificate *x509.Certificate, agentName string) bool {
+	return certificate.Subject.CommonName == agentName || constant.StringInList(agentName, certificate.DNSNames)
+}
+
+// loadAgentCertificates loads the certificate of this agent and checks that
+// it was issued for the identity key
+func loadAgentCertificates(publicKey *PublicKey) ([]*x509.Certificate, error) {
+	cfg := config.GetConfig()
+	if cfg.PKI.CertificateFile == "" {
+		return nil, nil
+	}
+
+	certificates, err := loadCertificates(cfg.PKI.CertificateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf := certificates[0]
+	if !certificateMatchesKey(leaf, publicKey.Signing) {
+		return nil, errors.New("certificate was not issued for the key of this agent, create a new request with 'azmft keys csr'")
+	}
+	if !certificateNamesAgent(leaf, cfg.Agent.Name) {
+		return nil, fmt.Errorf("certificate does not name agent '%s' in its subject or SAN", cfg.Agent.Name)
+	}
+	if time.Until(leaf.NotAfter) < certificateExpiryWarning {
+		log.Warn(fmt.Sprintf("Certificate of this agent expires on %s", leaf.NotAfter.Format(time.RFC3339)))
+	}
+	return certificates, nil
+}
+
+// verifyCertificate checks that a published key is backed by a certificate
+// chained to the root CA, valid now and naming the agent. Keys without a
+// certificate are accepted unless certificates are required.
+func verifyCertificate(agentName string, publicKey *PublicKey) error {
+	pki := config.GetConfig().PKI
+
+	if pki.RootCAFile == "" {
+		return nil
+	}
+	if len(publicKey.Certificates) == 0 {
+		if pki.RequireCertificates {
+			return fmt.Errorf("key of agent '%s' has no certificate", agentName)
+		}
+		return nil
+	}
+
+	rootCertificates, err := loadCertificates(pki.RootCAFile)
+	if err != nil {
+		return err
+	}
+
+	roots := x509.NewCertPool()
+	for _, certificate := range rootCertificates {
+		roots.AddCert(certificate)
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range publicKey.Certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	leaf := publicKey.Certificates[0]
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return err
+	}
+
+	if !certificateNamesAgent(leaf, agentName) {
+		return fmt.Errorf("certificate does not name agent '%s'", agentName)
+	}
+	if !certificateMatchesKey(leaf, publicKey.Signing) {
+		return fmt.Errorf("certificate of agent '%s' does not match its published key", agentName)
+	}
+	return nil
+}
+
+// CreateCertificateRequest creates a PEM encoded certificate signing request
+// for the key of this agent, naming the agent in the subject and SAN
+func CreateCertificateRequest() ([]byte, error) {
+	fp, ok := provider.(*fileProvider)
+	if !ok {
+		return nil, errors.New("the key provider cannot create certificate requests, create one with the signing agent instead")
+	}
+
+	agentName := config.GetConfig().Agent.Name
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: agentName},
+		DNSNames: []string{agentName},
+	}
+	if fp.publicKey.Algorithm == constant.KeyAlgorithmRSAPSS {
+		template.SignatureAlgorithm = x509.SHA256WithRSAPSS
+	}
+
+	request, err := x509.CreateCertificateRequest(rand.Reader, template, fp.privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: request,
+	}), nil
+}
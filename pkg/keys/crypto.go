@@ -1,13 +1,13 @@
 package keys
 
 import (
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
-
-	"github.com/willhackett/azure-mft/pkg/config"
 )
 
 // EncryptString encrypts using the public key of another agent
@@ -18,9 +18,17 @@ func EncryptString(agentName string, keyID string, plaintext string) (string, er
 		return "", err
 	}
 
-	hash := sha256.New()
+	var ciphertext []byte
 	bytes := []byte(plaintext)
-	ciphertext, err := rsa.EncryptOAEP(hash, rand.Reader, publicKey, bytes, nil)
+
+	switch encryptionKey := publicKey.Encryption.(type) {
+	case *rsa.PublicKey:
+		ciphertext, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, encryptionKey, bytes, nil)
+	case *ecdh.PublicKey:
+		ciphertext, err = wrapECDH(encryptionKey, bytes)
+	default:
+		err = errors.New("unsupported encryption key")
+	}
 	if err != nil {
 		log.Debug("Failed to encrypt text", err)
 		return "", err
@@ -30,14 +38,12 @@ func EncryptString(agentName string, keyID string, plaintext string) (string, er
 
 // DecryptString decrypts using the private key of this agent
 func DecryptString(ciphertext string) (string, error) {
-	keys := config.GetKeys()
-
-	hash := sha256.New()
 	bytes, err := hex.DecodeString(ciphertext)
 	if err != nil {
 		return "", err
 	}
-	plaintext, err := rsa.DecryptOAEP(hash, rand.Reader, keys.PrivateKey, bytes, nil)
+
+	plaintext, err := provider.Decrypt(bytes)
 	if err != nil {
 		log.Debug("Failed to decrypt ciphertext", err)
 		return "", err
@@ -0,0 +1,325 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/azure"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+const (
+	approvalBlockType = "AZMFT APPROVAL"
+
+	// approvalVersion is the signing format of approvals. Approvals without
+	// it were signed over concatenated fields, which is ambiguous.
+	approvalVersion = "2"
+)
+
+// ErrKeyNotApproved is returned when approval is required and a key has not
+// been countersigned by an administrator
+var ErrKeyNotApproved = errors.New("key has not been approved by an administrator")
+
+// algorithmForKey picks the signing algorithm of an administrator key
+func algorithmForKey(publicKey crypto.PublicKey) (string, error) {
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		return constant.KeyAlgorithmRSAPSS, nil
+	case ed25519.PublicKey:
+		return constant.KeyAlgorithmEd25519, nil
+	case *ecdsa.PublicKey:
+		return constant.KeyAlgorithmECDSAP256, nil
+	}
+	return "", errors.New("unsupported administrator key")
+}
+
+// approvalVerifierString encodes the signed fields as a JSON array so that no
+// two approvals sign the same bytes
+func approvalVerifierString(agentName string, keyID string, fingerprint string, approvedAt string) []byte {
+	bytes, _ := json.Marshal([]interface{}{approvalVersion, agentName, keyID, fingerprint, approvedAt})
+	return bytes
+}
+
+// loadAdminKey reads a PKCS#8 administrator private key
+func loadAdminKey(fileName string) (crypto.Signer, *PublicKey, error) {
+	if err := checkFilePermissions(fileName); err != nil {
+		return nil, nil, err
+	}
+
+	adminKeyPem, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(adminKeyPem)
+	if block == nil {
+		return nil, nil, errors.New("failed to decode administrator key")
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := parsedKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("administrator key cannot be used for signing")
+	}
+
+	algorithm, err := algorithmForKey(signer.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, &PublicKey{Algorithm: algorithm, Signing: signer.Public()}, nil
+}
+
+// loadAdminPublicKeys reads the administrator public keys trusted to approve
+// new agent keys
+func loadAdminPublicKeys() ([]*PublicKey, error) {
+	adminKeys := []*PublicKey{}
+
+	for _, fileName := range config.GetConfig().Enrollment.AdminPublicKeys {
+		adminKeyPem, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(adminKeyPem)
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode administrator key %s", fileName)
+		}
+		parsedKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		algorithm, err := algorithmForKey(parsedKey)
+		if err != nil {
+			return nil, err
+		}
+		adminKeys = append(adminKeys, &PublicKey{Algorithm: algorithm, Signing: parsedKey})
+	}
+	return adminKeys, nil
+}
+
+// verifyApproval checks that a published key carries a countersignature from
+// a configured administrator when approval is required
+func verifyApproval(agentName string, keyID string, publicKey *PublicKey) error {
+	if !config.GetConfig().Enrollment.RequireApproval {
+		return nil
+	}
+
+	fingerprint, err := Fingerprint(publicKey)
+	if err != nil {
+		return err
+	}
+
+	adminKeys, err := loadAdminPublicKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, approval := range publicKey.Approvals {
+		headers := approval.Headers
+		if headers["Version"] != approvalVersion {
+			continue
+		}
+		if headers["Agent"] != agentName || headers["KeyID"] != keyID || headers["Fingerprint"] != fingerprint {
+			continue
+		}
+
+		for _, adminKey := range adminKeys {
+			adminFingerprint, err := Fingerprint(adminKey)
+			if err != nil || adminFingerprint != headers["Admin"] {
+				continue
+			}
+
+			body := approvalVerifierString(agentName, keyID, fingerprint, headers["ApprovedAt"])
+			if err := verify(adminKey, body, approval.Bytes); err == nil {
+				return nil
+			}
+		}
+	}
+	return ErrKeyNotApproved
+}
+
+// publishPublicKey uploads the public key of this agent. Approvals on a key
+// that is already published are carried over; otherwise, when approval is
+// required, the key lands in the pending keys container.
+func publishPublicKey(agentName string, keyID string, publicKey *PublicKey) error {
+	keyReference := constant.AgentKeyName(agentName, keyID)
+
+	existingBytes, err := azure.DownloadBuffer(constant.PublicKeyContainerName, keyReference)
+	if err != nil && !azure.IsBlobNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if existing, err := parsePublicKey(existingBytes); err == nil {
+			// Approvals in an earlier format are dropped so that the key is approved again
+			for _, approval := range existing.Approvals {
+				if approval.Headers["Version"] == approvalVersion {
+					publicKey.Approvals = append(publicKey.Approvals, approval)
+				}
+			}
+		}
+	}
+
+	publicKeyBytes, err := marshalPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	if len(publicKey.Approvals) == 0 && config.GetConfig().Enrollment.RequireApproval {
+		if err := azure.UploadBuffer(constant.PendingKeyContainerName, keyReference, publicKeyBytes); err != nil {
+			return err
+		}
+		fingerprint, err := Fingerprint(publicKey)
+		if err != nil {
+			return err
+		}
+		log.Warn(fmt.Sprintf("Key '%s' is awaiting approval, an administrator must run 'azmft admin approve %s %s --fingerprint %s'", keyID, agentName, keyID, fingerprint))
+		return nil
+	}
+
+	return azure.UploadBuffer(constant.PublicKeyContainerName, keyReference, publicKeyBytes)
+}
+
+// ListPendingKeys returns the agent key references awaiting approval
+func ListPendingKeys() ([]string, error) {
+	return azure.ListBlobs(constant.PendingKeyContainerName)
+}
+
+// getPendingKey downloads a key awaiting approval and returns it with its
+// fingerprint
+func getPendingKey(agentName string, keyID string) (*PublicKey, string, error) {
+	keyReference := constant.AgentKeyName(agentName, keyID)
+
+	publicKeyBytes, err := azure.DownloadBuffer(constant.PendingKeyContainerName, keyReference)
+	if err != nil {
+		return nil, "", err
+	}
+	publicKey, err := parsePublicKey(publicKeyBytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The key ID is derived from the key, so a mismatch means the blob was tampered with
+	actualKeyID, err := generatePublicKeyID(publicKey.Signing)
+	if err != nil {
+		return nil, "", err
+	}
+	if actualKeyID != keyID {
+		return nil, "", fmt.Errorf("pending key '%s' has key ID '%s'", keyReference, actualKeyID)
+	}
+
+	fingerprint, err := Fingerprint(publicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return publicKey, fingerprint, nil
+}
+
+// PendingKeyFingerprint returns the fingerprint of a key awaiting approval, to
+// be compared with the one the agent reports before approving it
+func PendingKeyFingerprint(agentName string, keyID string) (string, error) {
+	_, fingerprint, err := getPendingKey(agentName, keyID)
+	return fingerprint, err
+}
+
+// Approve countersigns a pending key with an administrator key and publishes
+// it so that peers trust it. The key ID is short, so the fingerprint the
+// agent reports must be given to show that the pending key is the agent's.
+func Approve(agentName string, keyID string, expectedFingerprint string, adminKeyFile string) (string, error) {
+	keyReference := constant.AgentKeyName(agentName, keyID)
+
+	expectedFingerprint, err := normaliseFingerprint(expectedFingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	publicKey, fingerprint, err := getPendingKey(agentName, keyID)
+	if err != nil {
+		return "", err
+	}
+	if fingerprint != expectedFingerprint {
+		return "", fmt.Errorf("pending key '%s' has fingerprint %s, not %s", keyReference, fingerprint, expectedFingerprint)
+	}
+
+	adminKey, adminPublicKey, err := loadAdminKey(adminKeyFile)
+	if err != nil {
+		return "", err
+	}
+	adminFingerprint, err := Fingerprint(adminPublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	approvedAt := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := sign(adminPublicKey.Algorithm, adminKey, approvalVerifierString(agentName, keyID, fingerprint, approvedAt))
+	if err != nil {
+		return "", err
+	}
+
+	publicKey.Approvals = append(publicKey.Approvals, &pem.Block{
+		Type: approvalBlockType,
+		Headers: map[string]string{
+			"Version":     approvalVersion,
+			"Agent":       agentName,
+			"KeyID":       keyID,
+			"Fingerprint": fingerprint,
+			"Admin":       adminFingerprint,
+			"ApprovedAt":  approvedAt,
+		},
+		Bytes: signature,
+	})
+
+	approvedBytes, err := marshalPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	if err := azure.UploadBuffer(constant.PublicKeyContainerName, keyReference, approvedBytes); err != nil {
+		return "", err
+	}
+
+	return fingerprint, azure.DeleteBlob(constant.PendingKeyContainerName, keyReference)
+}
+
+// GenerateAdminKey writes a new Ed25519 administrator private key to a file
+// and returns the PEM encoded public key to distribute to agents
+func GenerateAdminKey(fileName string) ([]byte, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	err = writePrivateFile(fileName, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	}), nil
+}
@@ -0,0 +1,133 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+func TestApprovalVerifierStringIsUnambiguous(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+	}{
+		{"agent and key ID boundary", []string{"agent1", "23abc", "ff", "1"}, []string{"agent", "123abc", "ff", "1"}},
+		{"fingerprint and approved at boundary", []string{"agent", "abc", "ff1", "2"}, []string{"agent", "abc", "ff", "12"}},
+		{"key ID and fingerprint boundary", []string{"agent", "abcf", "f", "1"}, []string{"agent", "abc", "ff", "1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := approvalVerifierString(test.a[0], test.a[1], test.a[2], test.a[3])
+			b := approvalVerifierString(test.b[0], test.b[1], test.b[2], test.b[3])
+			if bytes.Equal(a, b) {
+				t.Errorf("approvals sign the same bytes: %s", a)
+			}
+		})
+	}
+}
+
+// approvalFor countersigns an agent key with an administrator key the way
+// Approve does, letting the test change the headers afterwards
+func approvalFor(t *testing.T, adminKeyFile string, agentName string, keyID string, fingerprint string) *pem.Block {
+	adminKey, adminPublicKey, err := loadAdminKey(adminKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminFingerprint, err := Fingerprint(adminPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	approvedAt := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := sign(adminPublicKey.Algorithm, adminKey, approvalVerifierString(agentName, keyID, fingerprint, approvedAt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pem.Block{
+		Type: approvalBlockType,
+		Headers: map[string]string{
+			"Version":     approvalVersion,
+			"Agent":       agentName,
+			"KeyID":       keyID,
+			"Fingerprint": fingerprint,
+			"Admin":       adminFingerprint,
+			"ApprovedAt":  approvedAt,
+		},
+		Bytes: signature,
+	}
+}
+
+func TestVerifyApproval(t *testing.T) {
+	dir := t.TempDir()
+	adminKeyFile := filepath.Join(dir, "admin.pem")
+	adminPublicKeyFile := filepath.Join(dir, "admin.pub")
+
+	adminPublicKeyPem, err := GenerateAdminKey(adminKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(adminPublicKeyFile, adminPublicKeyPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Set(config.Config{Enrollment: config.EnrollmentConf{
+		RequireApproval: true,
+		AdminPublicKeys: []string{adminPublicKeyFile},
+	}})
+	defer config.Set(config.Config{})
+
+	signing, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey := func() *PublicKey {
+		return &PublicKey{Algorithm: constant.KeyAlgorithmEd25519, Signing: signing}
+	}
+	keyID, err := generatePublicKeyID(signing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := Fingerprint(newKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		approve func(approval *pem.Block)
+		agent   string
+		wantErr bool
+	}{
+		{"approved", func(approval *pem.Block) {}, "agent", false},
+		{"other agent", func(approval *pem.Block) {}, "other", true},
+		{"earlier format", func(approval *pem.Block) { delete(approval.Headers, "Version") }, "agent", true},
+		{"altered approval time", func(approval *pem.Block) { approval.Headers["ApprovedAt"] = "1" }, "agent", true},
+		{"unknown administrator", func(approval *pem.Block) { approval.Headers["Admin"] = fingerprint }, "agent", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			approval := approvalFor(t, adminKeyFile, "agent", keyID, fingerprint)
+			test.approve(approval)
+
+			publicKey := newKey()
+			publicKey.Approvals = []*pem.Block{approval}
+
+			err := verifyApproval(test.agent, keyID, publicKey)
+			if (err != nil) != test.wantErr {
+				t.Errorf("verifyApproval() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+)
+
+// fileProvider holds the private keys loaded from the keys directory
+type fileProvider struct {
+	keyID         string
+	publicKey     *PublicKey
+	privateKey    crypto.Signer
+	encryptionKey crypto.PrivateKey
+}
+
+func (p *fileProvider) Sign(body []byte) ([]byte, error) {
+	return sign(p.publicKey.Algorithm, p.privateKey, body)
+}
+
+func (p *fileProvider) Decrypt(ciphertext []byte) ([]byte, error) {
+	switch encryptionKey := p.encryptionKey.(type) {
+	case *rsa.PrivateKey:
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, encryptionKey, ciphertext, nil)
+	case *ecdh.PrivateKey:
+		return unwrapECDH(encryptionKey, ciphertext)
+	}
+	return nil, errors.New("unsupported encryption key")
+}
+
+func (p *fileProvider) PublicKey() *PublicKey {
+	return p.publicKey
+}
+
+func (p *fileProvider) KeyID() string {
+	return p.keyID
+}
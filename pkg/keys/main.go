@@ -1,7 +1,7 @@
 package keys
 
 import (
-	"crypto/rand"
+	"crypto"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
@@ -10,96 +10,132 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"runtime"
 
 	"github.com/spf13/cobra"
-	"github.com/willhackett/azure-mft/pkg/azure"
 	"github.com/willhackett/azure-mft/pkg/config"
 	"github.com/willhackett/azure-mft/pkg/constant"
 	"github.com/willhackett/azure-mft/pkg/logger"
 )
 
+const (
+	// algorithmHeader declares the algorithm of a published signing key
+	algorithmHeader = "Alg"
+
+	// useHeader marks the published key used to wrap secrets
+	useHeader = "Use"
+
+	useEncryption = "encryption"
+)
+
 var (
 	log = logger.Get()
 )
 
-func generatePrivateKey() *rsa.PrivateKey {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		log.Fatal("Cannot generate RSA key", err)
-		os.Exit(1)
+func dumpPrivateKeyToFile(keysDir string, privateKey crypto.Signer, encryptionKey crypto.PrivateKey, passphrase []byte) error {
+	var privateKeyPem []byte
+
+	// RSA keys stay in PKCS#1 form so that keys created by earlier versions load
+	if rsaKey, ok := privateKey.(*rsa.PrivateKey); ok {
+		privateKeyPem = pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		})
+	} else {
+		for _, key := range []crypto.PrivateKey{privateKey, encryptionKey} {
+			privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return err
+			}
+			privateKeyPem = append(privateKeyPem, pem.EncodeToMemory(&pem.Block{
+				Type:  "PRIVATE KEY",
+				Bytes: privateKeyBytes,
+			})...)
+		}
 	}
-	return privateKey
+
+	if passphrase != nil {
+		encryptedPem, err := encryptPrivateKeyPem(privateKeyPem, passphrase)
+		if err != nil {
+			return err
+		}
+		privateKeyPem = encryptedPem
+	}
+
+	return writePrivateFile(keysDir+"/private.pem", privateKeyPem)
+}
+
+func dumpPublicKeyToFile(keysDir string, publicKeyBytes []byte) error {
+	return ioutil.WriteFile(keysDir+"/public.pem", publicKeyBytes, 0644)
 }
 
-func dumpPrivateKeyToFile(keysDir string, privateKey *rsa.PrivateKey) error {
-	var privateKeyBytes []byte = x509.MarshalPKCS1PrivateKey(privateKey)
-	privateKeyBlock := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privateKeyBytes,
+// readPrivateKeyPem reads the private key file, decrypting it if it was
+// stored with a passphrase, and reports whether it was encrypted
+func readPrivateKeyPem(keysDir string, passphrase []byte) ([]byte, bool, error) {
+	fileName := keysDir + "/private.pem"
+
+	if err := checkFilePermissions(fileName); err != nil {
+		return nil, false, err
 	}
-	privatePem, err := os.Create(keysDir + "/private.pem")
+
+	privateKeyPem, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-	err = pem.Encode(privatePem, privateKeyBlock)
-	if err != nil {
-		return err
+
+	block, _ := pem.Decode(privateKeyPem)
+	if block == nil || block.Type != encryptedPrivateKeyType {
+		return privateKeyPem, false, nil
 	}
-	return nil
+
+	privateKeyPem, err = decryptPrivateKeyPem(block, passphrase)
+	return privateKeyPem, true, err
 }
 
-func dumpPublicKeyToFile(keysDir string, privateKey *rsa.PrivateKey) error {
-	publicKey := &privateKey.PublicKey
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
-	if err != nil {
-		return err
+func parsePrivateKeyPem(privateKeyPem []byte) (crypto.Signer, crypto.PrivateKey, error) {
+	privateKeyBlock, rest := pem.Decode(privateKeyPem)
+	if privateKeyBlock == nil {
+		return nil, nil, errors.New("failed to decode private key")
 	}
-	publicKeyBlock := &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyBytes,
-	}
-	publicPem, err := os.Create(keysDir + "/public.pem")
-	if err != nil {
-		return err
-	}
-	err = pem.Encode(publicPem, publicKeyBlock)
-	if err != nil {
-		return err
+
+	if privateKeyBlock.Type == "RSA PRIVATE KEY" {
+		privateKey, err := x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, privateKey, nil
 	}
-	return nil
-}
 
-func loadKeysFromFile(keysDir string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
-	privateKeyPem, err := ioutil.ReadFile(keysDir + "/private.pem")
+	parsedPrivateKey, err := x509.ParsePKCS8PrivateKey(privateKeyBlock.Bytes)
 	if err != nil {
 		return nil, nil, err
 	}
-	publicKeyPem, err := ioutil.ReadFile(keysDir + "/public.pem")
-	if err != nil {
-		return nil, nil, err
+	privateKey, ok := parsedPrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("private key cannot be used for signing")
+	}
+	if rsaKey, ok := privateKey.(*rsa.PrivateKey); ok {
+		return rsaKey, rsaKey, nil
 	}
 
-	privateKeyBlock, _ := pem.Decode(privateKeyPem)
-	privateKey, err := x509.ParsePKCS1PrivateKey(privateKeyBlock.Bytes)
+	encryptionKeyBlock, _ := pem.Decode(rest)
+	if encryptionKeyBlock == nil {
+		return nil, nil, errors.New("failed to decode encryption key")
+	}
+	parsedEncryptionKey, err := x509.ParsePKCS8PrivateKey(encryptionKeyBlock.Bytes)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	publicKeyBlock, _ := pem.Decode(publicKeyPem)
-	publicKeyInt, err := x509.ParsePKIXPublicKey(publicKeyBlock.Bytes)
+	encryptionKey, err := toECDH(parsedEncryptionKey)
 	if err != nil {
 		return nil, nil, err
 	}
-	publicKey, ok := publicKeyInt.(*rsa.PublicKey)
-	if !ok {
-		return nil, nil, errors.New("failed to create public key")
-	}
-	return privateKey, publicKey, nil
+	return privateKey, encryptionKey, nil
 }
 
-func createDirIfNotExist(dir string) error {
+func createDirIfNotExist(dir string, perm os.FileMode) error {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		err := os.MkdirAll(dir, 0755)
+		err := os.MkdirAll(dir, perm)
 		if err != nil {
 			return err
 		}
@@ -107,7 +143,28 @@ func createDirIfNotExist(dir string) error {
 	return nil
 }
 
-func generatePublicKeyID(publicKey *rsa.PublicKey) (string, error) {
+// createPrivateDir creates a directory only the owner can use, tightening the
+// permissions of a directory that already exists
+func createPrivateDir(dir string) error {
+	if err := createDirIfNotExist(dir, 0700); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 == 0 {
+		return nil
+	}
+	log.Warn(fmt.Sprintf("Permissions %#o for %s are too open, restricting them to 0700", info.Mode().Perm(), dir))
+	return os.Chmod(dir, 0700)
+}
+
+func generatePublicKeyID(publicKey crypto.PublicKey) (string, error) {
 	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
 	if err != nil {
 		return "", err
@@ -117,68 +174,213 @@ func generatePublicKeyID(publicKey *rsa.PublicKey) (string, error) {
 	return fmt.Sprintf("%x", publicKeyHash)[0:9], nil
 }
 
-func marshalPublicKey(publicKey *rsa.PublicKey) ([]byte, error) {
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+// marshalPublicKey encodes the published identity of an agent. The signing key
+// declares its algorithm in a PEM header and is followed by its certificate
+// chain and administrator approvals, if any. Elliptic curve algorithms append
+// a final block holding the ECDH key used to wrap secrets.
+func marshalPublicKey(publicKey *PublicKey) ([]byte, error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey.Signing)
 	if err != nil {
 		return nil, err
 	}
 
 	publicKeyBlock := &pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyBytes,
+		Type:    "PUBLIC KEY",
+		Headers: map[string]string{algorithmHeader: publicKey.Algorithm},
+		Bytes:   publicKeyBytes,
+	}
+	encoded := pem.EncodeToMemory(publicKeyBlock)
+	encoded = append(encoded, marshalCertificates(publicKey.Certificates)...)
+
+	for _, approval := range publicKey.Approvals {
+		encoded = append(encoded, pem.EncodeToMemory(approval)...)
 	}
 
+	if _, ok := publicKey.Encryption.(*rsa.PublicKey); ok {
+		return encoded, nil
+	}
+
+	encryptionKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey.Encryption)
 	if err != nil {
 		return nil, err
 	}
 
-	return pem.EncodeToMemory(publicKeyBlock), nil
+	encryptionKeyBlock := &pem.Block{
+		Type:    "PUBLIC KEY",
+		Headers: map[string]string{useHeader: useEncryption},
+		Bytes:   encryptionKeyBytes,
+	}
+
+	return append(encoded, pem.EncodeToMemory(encryptionKeyBlock)...), nil
+}
+
+// parsePublicKey decodes a published identity. Keys published without an
+// algorithm header are legacy RSA PKCS#1 v1.5 keys.
+func parsePublicKey(publicKeyBytes []byte) (*PublicKey, error) {
+	publicKey := &PublicKey{}
+
+	for block, rest := pem.Decode(publicKeyBytes); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			publicKey.Certificates = append(publicKey.Certificates, certificate)
+			continue
+		}
+		if block.Type == approvalBlockType {
+			publicKey.Approvals = append(publicKey.Approvals, block)
+			continue
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+
+		parsedPublicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if block.Headers[useHeader] == useEncryption {
+			if publicKey.Encryption, err = toECDH(parsedPublicKey); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		publicKey.Signing = parsedPublicKey
+		publicKey.Algorithm = block.Headers[algorithmHeader]
+		if publicKey.Algorithm == "" {
+			publicKey.Algorithm = constant.KeyAlgorithmRSA
+		}
+	}
+
+	if publicKey.Signing == nil {
+		return nil, errors.New("failed to create public key")
+	}
+	if !keyMatchesAlgorithm(publicKey.Algorithm, publicKey.Signing) {
+		return nil, fmt.Errorf("public key does not match algorithm '%s'", publicKey.Algorithm)
+	}
+	if rsaKey, ok := publicKey.Signing.(*rsa.PublicKey); ok {
+		publicKey.Encryption = rsaKey
+	}
+	if publicKey.Encryption == nil {
+		return nil, errors.New("public key has no encryption key")
+	}
+	return publicKey, nil
 }
 
-func getKeys(keysDir string) (*rsa.PrivateKey, *rsa.PublicKey, string, error) {
-	err := createDirIfNotExist(keysDir)
+func getKeys(keysDir string, algorithm string) (*fileProvider, error) {
+	err := createPrivateDir(keysDir)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, err
 	}
 
-	privateKey, publicKey, err := loadKeysFromFile(keysDir)
-	if err != nil || publicKey == nil || privateKey == nil {
-		privateKey = generatePrivateKey()
-		err = dumpPrivateKeyToFile(keysDir, privateKey)
+	passphrase, err := getPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	var privateKey crypto.Signer
+	var encryptionKey crypto.PrivateKey
+
+	privateKeyPem, encrypted, err := readPrivateKeyPem(keysDir, passphrase)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		privateKey, encryptionKey, err = parsePrivateKeyPem(privateKeyPem)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Replacing the key would lose the identity of the agent, along with the
+	// pins and approvals of peers, so it is left to the administrator
+	if privateKey != nil && !keyMatchesAlgorithm(algorithm, privateKey.Public()) {
+		return nil, fmt.Errorf("the key in %s cannot be used with algorithm '%s'; set the algorithm back, or move the key to a backup to generate a new one, which peers must pin and approve again", keysDir+"/private.pem", algorithm)
+	}
+
+	if privateKey == nil {
+		privateKey, encryptionKey, err = generateKeys(algorithm)
 		if err != nil {
-			return nil, nil, "", err
+			return nil, err
 		}
-		err = dumpPublicKeyToFile(keysDir, privateKey)
+		err = dumpPrivateKeyToFile(keysDir, privateKey, encryptionKey, passphrase)
 		if err != nil {
-			return nil, nil, "", err
+			return nil, err
 		}
+	} else if passphrase != nil && !encrypted {
+		log.Info("Encrypting existing private key with the configured passphrase")
+		err = dumpPrivateKeyToFile(keysDir, privateKey, encryptionKey, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if passphrase == nil {
+		log.Warn("Private key is stored unencrypted, configure a key passphrase to protect it at rest")
 	}
-	privateKey, publicKey, err = loadKeysFromFile(keysDir)
+
+	publicKey := &PublicKey{
+		Algorithm:  algorithm,
+		Signing:    privateKey.Public(),
+		Encryption: publicEncryptionKey(encryptionKey),
+	}
+	publicKeyBytes, err := marshalPublicKey(publicKey)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, err
+	}
+	err = dumpPublicKeyToFile(keysDir, publicKeyBytes)
+	if err != nil {
+		return nil, err
 	}
 
-	keyID, err := generatePublicKeyID(publicKey)
+	keyID, err := generatePublicKeyID(publicKey.Signing)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, err
 	}
 
-	return privateKey, publicKey, keyID, err
+	return &fileProvider{
+		keyID:         keyID,
+		publicKey:     publicKey,
+		privateKey:    privateKey,
+		encryptionKey: encryptionKey,
+	}, nil
+}
+
+func publicEncryptionKey(encryptionKey crypto.PrivateKey) crypto.PublicKey {
+	if k, ok := encryptionKey.(interface{ Public() crypto.PublicKey }); ok {
+		return k.Public()
+	}
+	return nil
 }
 
 func Init() {
-	keysDir := config.GetConfig().Paths.KeysDir
+	var err error
+	cfg := config.GetConfig()
 
-	privateKey, publicKey, keyID, err := getKeys(keysDir)
+	provider, err = newProvider()
 	cobra.CheckErr(err)
 
-	config.SetKeys(privateKey, publicKey, keyID)
-	keyReference := constant.AgentKeyName(config.GetConfig().Agent.Name, keyID)
+	keyID := provider.KeyID()
 
-	publicKeyBytes, err := marshalPublicKey(publicKey)
+	publicKey := *provider.PublicKey()
+	publicKey.Certificates, err = loadAgentCertificates(&publicKey)
 	cobra.CheckErr(err)
-	err = azure.UploadBuffer(constant.PublicKeyContainerName, keyReference, publicKeyBytes)
+
+	err = publishPublicKey(cfg.Agent.Name, keyID, &publicKey)
 	cobra.CheckErr(err)
 
-	log.Debug(fmt.Sprintf("Updated key '%s' in public keys storage container", keyID))
+	log.Debug(fmt.Sprintf("Published %s key '%s'", provider.PublicKey().Algorithm, keyID))
+
+	if err := loadRevocationCache(); err != nil {
+		log.Warn("Failed to load cached key revocations", err)
+	}
+	if err := RefreshRevocations(); err != nil {
+		log.Warn("Failed to refresh key revocation list", err)
+	}
+	if IsRevoked(cfg.Agent.Name, keyID) {
+		log.Warn(fmt.Sprintf("Key '%s' of this agent has been revoked and must be replaced", keyID))
+	}
 }
@@ -0,0 +1,190 @@
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	encryptedPrivateKeyType = "AZMFT ENCRYPTED PRIVATE KEY"
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	saltSize = 16
+
+	// Bounds on scrypt parameters read from a key file, so that a crafted
+	// header cannot exhaust memory or CPU. scryptMaxMemory is 128*N*r bytes.
+	scryptMaxN      = 1 << 20
+	scryptMaxR      = 32
+	scryptMaxP      = 16
+	scryptMaxMemory = 1 << 30
+)
+
+// getPassphrase returns the passphrase protecting the private key. A systemd
+// credential takes precedence over a passphrase file, which takes precedence
+// over the environment. A nil passphrase means the key is stored unencrypted.
+func getPassphrase() ([]byte, error) {
+	keysConf := config.GetConfig().Keys
+
+	if keysConf.PassphraseCredential != "" {
+		credentialsDir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if credentialsDir == "" {
+			return nil, errors.New("keys.passphrase_credential is set but CREDENTIALS_DIRECTORY is not, is the service started by systemd with LoadCredential?")
+		}
+		return readPassphraseFile(filepath.Join(credentialsDir, keysConf.PassphraseCredential))
+	}
+
+	if keysConf.PassphraseFile != "" {
+		if err := checkFilePermissions(keysConf.PassphraseFile); err != nil {
+			return nil, err
+		}
+		return readPassphraseFile(keysConf.PassphraseFile)
+	}
+
+	if passphrase := os.Getenv(keysConf.PassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	return nil, nil
+}
+
+func readPassphraseFile(fileName string) ([]byte, error) {
+	bytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase := strings.TrimRight(string(bytes), "\r\n")
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase file %s is empty", fileName)
+	}
+	return []byte(passphrase), nil
+}
+
+// checkFilePermissions refuses secrets that are readable by other users
+func checkFilePermissions(fileName string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("permissions %#o for %s are too open, run chmod 600 %s", info.Mode().Perm(), fileName, fileName)
+	}
+	return nil
+}
+
+// writePrivateFile writes a file that only the owner can read, tightening the
+// permissions of a file that already exists
+func writePrivateFile(fileName string, bytes []byte) error {
+	if err := ioutil.WriteFile(fileName, bytes, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(fileName, 0600)
+}
+
+func deriveKey(passphrase []byte, salt []byte, n int, r int, p int) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, n, r, p, 32)
+}
+
+// encryptPrivateKeyPem seals the PEM encoded private keys with a key derived
+// from the passphrase using scrypt and AES-256-GCM
+func encryptPrivateKeyPem(privateKeyPem []byte, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedPrivateKeyType,
+		Headers: map[string]string{
+			"KDF":   "scrypt",
+			"N":     strconv.Itoa(scryptN),
+			"R":     strconv.Itoa(scryptR),
+			"P":     strconv.Itoa(scryptP),
+			"Salt":  hex.EncodeToString(salt),
+			"Nonce": hex.EncodeToString(nonce),
+		},
+		Bytes: gcm.Seal(nil, nonce, privateKeyPem, nil),
+	}), nil
+}
+
+// decryptPrivateKeyPem reverses encryptPrivateKeyPem
+func decryptPrivateKeyPem(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if passphrase == nil {
+		return nil, errors.New("private key is encrypted but no passphrase is configured")
+	}
+	if block.Headers["KDF"] != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation function '%s'", block.Headers["KDF"])
+	}
+
+	var params [3]int
+	for i, name := range []string{"N", "R", "P"} {
+		value, err := strconv.Atoi(block.Headers[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid scrypt parameter %s", name)
+		}
+		params[i] = value
+	}
+	if params[0] < 2 || params[0] > scryptMaxN || params[1] < 1 || params[1] > scryptMaxR || params[2] < 1 || params[2] > scryptMaxP || 128*params[0]*params[1] > scryptMaxMemory {
+		return nil, fmt.Errorf("scrypt parameters N=%d R=%d P=%d are out of range", params[0], params[1], params[2])
+	}
+
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(passphrase, salt, params[0], params[1], params[2])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+
+	privateKeyPem, err := gcm.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt private key, is the passphrase correct?")
+	}
+	return privateKeyPem, nil
+}
@@ -0,0 +1,40 @@
+package keys
+
+import (
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+// KeyProvider signs and decrypts on behalf of this agent so that the private
+// key does not have to live in the daemon process
+type KeyProvider interface {
+	// Sign signs the body with the algorithm of the identity key
+	Sign(body []byte) ([]byte, error)
+
+	// Decrypt unwraps a secret that was encrypted for this agent
+	Decrypt(ciphertext []byte) ([]byte, error)
+
+	// PublicKey returns the identity published for this agent
+	PublicKey() *PublicKey
+
+	// KeyID identifies the public key in the public keys container
+	KeyID() string
+}
+
+var (
+	provider KeyProvider
+)
+
+// GetProvider returns the key provider initialised by Init
+func GetProvider() KeyProvider {
+	return provider
+}
+
+func newProvider() (KeyProvider, error) {
+	cfg := config.GetConfig()
+
+	if cfg.Keys.Provider == constant.KeyProviderAgent {
+		return newAgentProvider(cfg.Keys.AgentSocket)
+	}
+	return getKeys(cfg.Paths.KeysDir, cfg.Agent.KeyAlgorithm)
+}
@@ -0,0 +1,266 @@
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/willhackett/azure-mft/pkg/azure"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+// ErrKeyRevoked is returned when a key appears on the revocation list
+var ErrKeyRevoked = errors.New("key has been revoked")
+
+const (
+	revocationUpdateAttempts = 5
+
+	// revocationVersion is the signing format of revocations. Entries without
+	// it were signed over concatenated fields, which is ambiguous.
+	revocationVersion = 2
+)
+
+// Revocation is a single entry of the revocation list. Each entry is signed by
+// the agent that issued it so that peers can discard forged entries.
+type Revocation struct {
+	Version     int    `json:"version,omitempty"`
+	Agent       string `json:"agent"`
+	KeyID       string `json:"key_id"`
+	RevokedAt   int64  `json:"revoked_at"`
+	RevokedBy   string `json:"revoked_by"`
+	SignerKeyID string `json:"signer_key_id"`
+	Signature   string `json:"signature"`
+}
+
+// RevocationList is stored in the public keys container and cached locally
+type RevocationList struct {
+	Revocations []Revocation `json:"revocations"`
+}
+
+var (
+	revokedMutex sync.RWMutex
+
+	// revoked is sticky: once a key is seen on a valid revocation list it stays
+	// revoked locally even if the remote list is later altered or deleted
+	revoked = make(map[string]Revocation)
+)
+
+// verifierString encodes the signed fields as a JSON array so that no two
+// revocations sign the same bytes
+func (r Revocation) verifierString() []byte {
+	bytes, _ := json.Marshal([]interface{}{r.Version, r.Agent, r.KeyID, r.RevokedAt, r.RevokedBy, r.SignerKeyID})
+	return bytes
+}
+
+// canRevoke reports whether signer is allowed to revoke keys of agentName. An
+// agent may always revoke its own keys, otherwise the signer must be listed
+// as a revocation authority.
+func canRevoke(signer string, agentName string) bool {
+	return signer == agentName || constant.StringInList(signer, config.GetConfig().RevocationAuthorities)
+}
+
+func verifyRevocation(r Revocation) error {
+	if !canRevoke(r.RevokedBy, r.Agent) {
+		return fmt.Errorf("agent '%s' is not allowed to revoke keys of agent '%s'", r.RevokedBy, r.Agent)
+	}
+
+	if r.Version != revocationVersion {
+		return fmt.Errorf("revocation is in an unsupported format, it must be issued again")
+	}
+	if IsRevoked(r.RevokedBy, r.SignerKeyID) {
+		return fmt.Errorf("signing key '%s' of agent '%s' has been revoked", r.SignerKeyID, r.RevokedBy)
+	}
+
+	// The key of this agent is known locally, the published copy may have been replaced
+	if r.RevokedBy == config.GetConfig().Agent.Name && r.SignerKeyID == provider.KeyID() {
+		return verifyBytes(provider.PublicKey(), r.verifierString(), r.Signature)
+	}
+
+	publicKey, err := fetchPublicKey(r.RevokedBy, r.SignerKeyID)
+	if err != nil {
+		return err
+	}
+	if err := verifyBytes(publicKey, r.verifierString(), r.Signature); err != nil {
+		return err
+	}
+
+	// The published key of the authority must be the one pinned for it
+	return checkTrust(r.RevokedBy, r.SignerKeyID, publicKey)
+}
+
+func revocationCachePath() string {
+	return filepath.Join(config.GetConfig().Paths.CacheDir, constant.RevocationListBlobName)
+}
+
+func loadRevocationCache() error {
+	bytes, err := ioutil.ReadFile(revocationCachePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	list := RevocationList{}
+	if err := json.Unmarshal(bytes, &list); err != nil {
+		return err
+	}
+
+	revokedMutex.Lock()
+	defer revokedMutex.Unlock()
+
+	for _, r := range list.Revocations {
+		revoked[constant.AgentKeyName(r.Agent, r.KeyID)] = r
+	}
+	return nil
+}
+
+func saveRevocationCache() error {
+	revokedMutex.RLock()
+	list := RevocationList{Revocations: make([]Revocation, 0, len(revoked))}
+	for _, r := range revoked {
+		list.Revocations = append(list.Revocations, r)
+	}
+	revokedMutex.RUnlock()
+
+	bytes, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	if err := createDirIfNotExist(config.GetConfig().Paths.CacheDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(revocationCachePath(), bytes, 0600)
+}
+
+// downloadRevocationList fetches the remote revocation list. A missing list is
+// treated as empty and returns an empty ETag.
+func downloadRevocationList() (RevocationList, azblob.ETag, error) {
+	list := RevocationList{}
+
+	bytes, etag, err := azure.DownloadBufferWithETag(constant.PublicKeyContainerName, constant.RevocationListBlobName)
+	if err != nil {
+		if azure.IsBlobNotFound(err) {
+			return list, azblob.ETagNone, nil
+		}
+		return list, azblob.ETagNone, err
+	}
+
+	if err := json.Unmarshal(bytes, &list); err != nil {
+		return list, azblob.ETagNone, err
+	}
+	return list, etag, nil
+}
+
+// IsRevoked reports whether the key of an agent has been revoked
+func IsRevoked(agentName string, keyID string) bool {
+	revokedMutex.RLock()
+	defer revokedMutex.RUnlock()
+
+	_, ok := revoked[constant.AgentKeyName(agentName, keyID)]
+	return ok
+}
+
+// RefreshRevocations downloads the revocation list, verifies each entry and
+// merges the valid entries into the local cache
+func RefreshRevocations() error {
+	list, _, err := downloadRevocationList()
+	if err != nil {
+		return err
+	}
+
+	added := 0
+	for _, r := range list.Revocations {
+		if IsRevoked(r.Agent, r.KeyID) {
+			continue
+		}
+		if err := verifyRevocation(r); err != nil {
+			log.Warn(fmt.Sprintf("Ignoring revocation of key '%s' of agent '%s': %s", r.KeyID, r.Agent, err))
+			continue
+		}
+
+		revokedMutex.Lock()
+		revoked[constant.AgentKeyName(r.Agent, r.KeyID)] = r
+		revokedMutex.Unlock()
+		added++
+	}
+
+	if added == 0 {
+		return nil
+	}
+
+	log.Info(fmt.Sprintf("Loaded %d new key revocations", added))
+	return saveRevocationCache()
+}
+
+// WatchRevocations refreshes the revocation list on an interval
+func WatchRevocations() {
+	ticker := time.NewTicker(constant.RevocationRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := RefreshRevocations(); err != nil {
+			log.Warn("Failed to refresh key revocation list", err)
+		}
+	}
+}
+
+// Revoke signs a revocation for the key of an agent with the key of this
+// agent and appends it to the revocation list
+func Revoke(agentName string, keyID string) error {
+	cfg := config.GetConfig()
+
+	if !canRevoke(cfg.Agent.Name, agentName) {
+		log.Warn(fmt.Sprintf("Agent '%s' is not a revocation authority, peers will only honour this revocation if it is listed in their revocation_authorities", cfg.Agent.Name))
+	}
+
+	r := Revocation{
+		Version:     revocationVersion,
+		Agent:       agentName,
+		KeyID:       keyID,
+		RevokedAt:   time.Now().Unix(),
+		RevokedBy:   cfg.Agent.Name,
+		SignerKeyID: provider.KeyID(),
+	}
+	signature, err := signBytes(r.verifierString())
+	if err != nil {
+		return err
+	}
+	r.Signature = signature
+
+	for attempt := 0; attempt < revocationUpdateAttempts; attempt++ {
+		list, etag, err := downloadRevocationList()
+		if err != nil {
+			return err
+		}
+		list.Revocations = append(list.Revocations, r)
+
+		bytes, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+
+		err = azure.UploadBufferIfMatch(constant.PublicKeyContainerName, constant.RevocationListBlobName, bytes, etag)
+		if err == nil {
+			revokedMutex.Lock()
+			revoked[constant.AgentKeyName(r.Agent, r.KeyID)] = r
+			revokedMutex.Unlock()
+
+			return saveRevocationCache()
+		}
+		if !azure.IsConditionNotMet(err) {
+			return err
+		}
+		log.Debug("Revocation list changed while updating, retrying")
+	}
+
+	return errors.New("revocation list is being modified concurrently, try again")
+}
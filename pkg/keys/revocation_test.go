@@ -0,0 +1,77 @@
+package keys
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+)
+
+func TestRevocationVerifierStringIsUnambiguous(t *testing.T) {
+	tests := []struct {
+		name string
+		a    Revocation
+		b    Revocation
+	}{
+		{
+			name: "agent and key ID boundary",
+			a:    Revocation{Version: revocationVersion, Agent: "agent1", KeyID: "23abc", RevokedAt: 1, RevokedBy: "admin", SignerKeyID: "k"},
+			b:    Revocation{Version: revocationVersion, Agent: "agent", KeyID: "123abc", RevokedAt: 1, RevokedBy: "admin", SignerKeyID: "k"},
+		},
+		{
+			name: "revoked at and revoked by boundary",
+			a:    Revocation{Version: revocationVersion, Agent: "agent", KeyID: "abc", RevokedAt: 12, RevokedBy: "3admin", SignerKeyID: "k"},
+			b:    Revocation{Version: revocationVersion, Agent: "agent", KeyID: "abc", RevokedAt: 123, RevokedBy: "admin", SignerKeyID: "k"},
+		},
+		{
+			name: "revoked by and signer key ID boundary",
+			a:    Revocation{Version: revocationVersion, Agent: "agent", KeyID: "abc", RevokedAt: 1, RevokedBy: "adminx", SignerKeyID: "k"},
+			b:    Revocation{Version: revocationVersion, Agent: "agent", KeyID: "abc", RevokedAt: 1, RevokedBy: "admin", SignerKeyID: "xk"},
+		},
+		{
+			name: "version",
+			a:    Revocation{Version: 1, Agent: "agent", KeyID: "abc", RevokedAt: 1, RevokedBy: "admin", SignerKeyID: "k"},
+			b:    Revocation{Version: revocationVersion, Agent: "agent", KeyID: "abc", RevokedAt: 1, RevokedBy: "admin", SignerKeyID: "k"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if bytes.Equal(test.a.verifierString(), test.b.verifierString()) {
+				t.Errorf("revocations sign the same bytes: %s", test.a.verifierString())
+			}
+		})
+	}
+}
+
+func TestRevocationVerifierStringIgnoresSignature(t *testing.T) {
+	r := Revocation{Version: revocationVersion, Agent: "agent", KeyID: "abc", RevokedAt: 1, RevokedBy: "admin", SignerKeyID: "k"}
+	signed := r
+	signed.Signature = "00ff"
+
+	if !bytes.Equal(r.verifierString(), signed.verifierString()) {
+		t.Error("signature is part of the signed bytes")
+	}
+}
+
+func TestCanRevoke(t *testing.T) {
+	config.Set(config.Config{RevocationAuthorities: []string{"security"}})
+	defer config.Set(config.Config{})
+
+	tests := []struct {
+		signer string
+		agent  string
+		want   bool
+	}{
+		{"agent", "agent", true},
+		{"security", "agent", true},
+		{"other", "agent", false},
+		{"", "agent", false},
+	}
+
+	for _, test := range tests {
+		if got := canRevoke(test.signer, test.agent); got != test.want {
+			t.Errorf("canRevoke(%q, %q) = %v, want %v", test.signer, test.agent, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package keys
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+// ErrKeyNotPinned is returned when the key of an allowed agent is not pinned
+// in the trust store
+var ErrKeyNotPinned = errors.New("key is not pinned in the trust store")
+
+var fingerprintPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Pin records a trusted key of an agent
+type Pin struct {
+	Fingerprint string `json:"fingerprint"`
+	KeyID       string `json:"key_id"`
+	AddedAt     int64  `json:"added_at"`
+	Source      string `json:"source"`
+}
+
+// TrustStore pins the key fingerprints of each trusted agent
+type TrustStore struct {
+	Agents map[string][]Pin `json:"agents"`
+}
+
+var (
+	trustMutex sync.Mutex
+)
+
+// Fingerprint returns the SHA-256 of the signing key of a public key
+func Fingerprint(publicKey *PublicKey) (string, error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey.Signing)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(publicKeyBytes)), nil
+}
+
+// normaliseFingerprint accepts fingerprints in upper case, with colons or
+// with a sha256: prefix
+func normaliseFingerprint(fingerprint string) (string, error) {
+	fingerprint = strings.ToLower(fingerprint)
+	fingerprint = strings.TrimPrefix(fingerprint, "sha256:")
+	fingerprint = strings.ReplaceAll(fingerprint, ":", "")
+
+	if !fingerprintPattern.MatchString(fingerprint) {
+		return "", errors.New("fingerprint must be a hex encoded SHA-256")
+	}
+	return fingerprint, nil
+}
+
+func loadTrustStore() (TrustStore, error) {
+	store := TrustStore{Agents: make(map[string][]Pin)}
+
+	bytes, err := ioutil.ReadFile(config.GetConfig().Paths.TrustStore)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return store, err
+	}
+
+	if err := json.Unmarshal(bytes, &store); err != nil {
+		return store, err
+	}
+	if store.Agents == nil {
+		store.Agents = make(map[string][]Pin)
+	}
+	return store, nil
+}
+
+func saveTrustStore(store TrustStore) error {
+	fileName := config.GetConfig().Paths.TrustStore
+
+	bytes, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := createDirIfNotExist(filepath.Dir(fileName), 0700); err != nil {
+		return err
+	}
+	return writePrivateFile(fileName, bytes)
+}
+
+func isPinned(pins []Pin, fingerprint string) bool {
+	for _, pin := range pins {
+		if pin.Fingerprint == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresPin reports whether messages from an agent must be signed by a
+// pinned key. Only agents in the allow lists and revocation authorities are
+// subject to pinning.
+func requiresPin(agentName string) bool {
+	cfg := config.GetConfig()
+
+	return constant.StringInList(agentName, cfg.AllowFilesFrom) ||
+		constant.StringInList(agentName, cfg.AllowRequestsFrom) ||
+		constant.StringInList(agentName, cfg.RevocationAuthorities)
+}
+
+// checkTrust verifies that the key of an allowed agent is pinned. In trust on
+// first use mode the first key seen for an agent without pins is pinned.
+func checkTrust(agentName string, keyID string, publicKey *PublicKey) error {
+	if !requiresPin(agentName) {
+		return nil
+	}
+
+	fingerprint, err := Fingerprint(publicKey)
+	if err != nil {
+		return err
+	}
+
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+
+	store, err := loadTrustStore()
+	if err != nil {
+		return err
+	}
+
+	pins := store.Agents[agentName]
+	if isPinned(pins, fingerprint) {
+		return nil
+	}
+
+	if len(pins) > 0 || config.GetConfig().Trust.Mode != constant.TrustModeTOFU {
+		log.Warn(fmt.Sprintf("Key '%s' of agent '%s' with fingerprint %s is not pinned, run 'azmft trust add %s %s' if it is expected", keyID, agentName, fingerprint, agentName, fingerprint))
+		return ErrKeyNotPinned
+	}
+
+	store.Agents[agentName] = append(pins, Pin{
+		Fingerprint: fingerprint,
+		KeyID:       keyID,
+		AddedAt:     time.Now().Unix(),
+		Source:      constant.TrustModeTOFU,
+	})
+	if err := saveTrustStore(store); err != nil {
+		return err
+	}
+
+	log.Info(fmt.Sprintf("Pinned key '%s' of agent '%s' on first use with fingerprint %s", keyID, agentName, fingerprint))
+	return nil
+}
+
+// Trust pins a key fingerprint for an agent
+func Trust(agentName string, fingerprint string) error {
+	fingerprint, err := normaliseFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+
+	store, err := loadTrustStore()
+	if err != nil {
+		return err
+	}
+	if isPinned(store.Agents[agentName], fingerprint) {
+		return nil
+	}
+
+	store.Agents[agentName] = append(store.Agents[agentName], Pin{
+		Fingerprint: fingerprint,
+		KeyID:       fingerprint[0:9],
+		AddedAt:     time.Now().Unix(),
+		Source:      "manual",
+	})
+	return saveTrustStore(store)
+}
+
+// Untrust removes a pinned key fingerprint of an agent
+func Untrust(agentName string, fingerprint string) error {
+	fingerprint, err := normaliseFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+
+	store, err := loadTrustStore()
+	if err != nil {
+		return err
+	}
+
+	pins := []Pin{}
+	for _, pin := range store.Agents[agentName] {
+		if pin.Fingerprint != fingerprint {
+			pins = append(pins, pin)
+		}
+	}
+	if len(pins) == len(store.Agents[agentName]) {
+		return fmt.Errorf("fingerprint %s is not pinned for agent '%s'", fingerprint, agentName)
+	}
+
+	if len(pins) == 0 {
+		delete(store.Agents, agentName)
+	} else {
+		store.Agents[agentName] = pins
+	}
+	return saveTrustStore(store)
+}
+
+// GetTrustStore returns the pinned keys of every agent
+func GetTrustStore() (TrustStore, error) {
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+
+	return loadTrustStore()
+}
@@ -1,84 +1,110 @@
 package keys
 
 import (
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
 	"encoding/hex"
-	"encoding/pem"
-	"errors"
 	"fmt"
 
 	"github.com/willhackett/azure-mft/pkg/azure"
-	"github.com/willhackett/azure-mft/pkg/config"
 	"github.com/willhackett/azure-mft/pkg/constant"
 )
 
-func getPublicKey(agentName string, keyID string) (*rsa.PublicKey, error) {
+func getPublicKey(agentName string, keyID string) (*PublicKey, error) {
+	if IsRevoked(agentName, keyID) {
+		log.Warn(fmt.Sprintf("Key '%s' from agent '%s' has been revoked", keyID, agentName))
+		return nil, ErrKeyRevoked
+	}
+
+	return fetchPublicKey(agentName, keyID)
+}
+
+// fetchPublicKey downloads a published public key and verifies its
+// certificate and approval without consulting the revocation list
+func fetchPublicKey(agentName string, keyID string) (*PublicKey, error) {
 	keyReference := constant.AgentKeyName(agentName, keyID)
 	publicKeyBytes, err := azure.DownloadBuffer(constant.PublicKeyContainerName, keyReference)
 	if err != nil {
 		return nil, err
 	}
 
-	decodedPublicKeyPem, _ := pem.Decode(publicKeyBytes)
-
-	// Convert the public key to an x509 public key
-	parsedPublicKey, err := x509.ParsePKIXPublicKey(decodedPublicKeyPem.Bytes)
+	publicKey, err := parsePublicKey(publicKeyBytes)
 	if err != nil {
 		log.Debug("Error parsing public key", err)
 		return nil, err
 	}
-	var publicKey *rsa.PublicKey
-	publicKey, ok := parsedPublicKey.(*rsa.PublicKey)
-	if !ok {
-		log.Debug("Failed coercing public key to rsa.PublicKey format")
-		return nil, errors.New("failed to create public key")
+
+	if err := verifyCertificate(agentName, publicKey); err != nil {
+		log.Warn(fmt.Sprintf("Certificate of key '%s' from agent '%s' cannot be verified: %s", keyID, agentName, err))
+		return nil, err
+	}
+	if err := verifyApproval(agentName, keyID, publicKey); err != nil {
+		log.Warn(fmt.Sprintf("Key '%s' from agent '%s' has not been approved by an administrator", keyID, agentName))
+		return nil, err
 	}
 	return publicKey, nil
 }
 
-func SignMessage(message *constant.Message) error {
-	verifierBody := constant.VerifierString(*message)
-	verifierHash := sha256.Sum256([]byte(verifierBody))
+// signBytes signs the body with the private key of this agent and returns the
+// hex encoded signature
+func signBytes(body []byte) (string, error) {
+	signature, err := provider.Sign(body)
+	if err != nil {
+		return "", err
+	}
 
-	keys := config.GetKeys()
+	return hex.EncodeToString(signature), nil
+}
 
-	signature, err := rsa.SignPKCS1v15(rand.Reader, keys.PrivateKey, crypto.SHA256, verifierHash[:])
+// verifyBytes checks a hex encoded signature of the body against a public key
+func verifyBytes(publicKey *PublicKey, body []byte, signature string) error {
+	signatureBytes, err := hex.DecodeString(signature)
 	if err != nil {
+		log.Debug("Error decoding hex string", err)
 		return err
 	}
 
-	message.Signature = hex.EncodeToString(signature)
+	return verify(publicKey, body, signatureBytes)
+}
+
+func SignMessage(message *constant.Message) error {
+	// Legacy RSA messages carry no algorithm so older agents can verify them
+	if alg := provider.PublicKey().Algorithm; alg != constant.KeyAlgorithmRSA {
+		message.Alg = alg
+	}
+
+	signature, err := signBytes(constant.VerifierString(*message))
+	if err != nil {
+		return err
+	}
+
+	message.Signature = signature
 
 	return nil
 }
 
 func VerifyMessage(message constant.Message) error {
-	// Compose the verifier of the message
-	verifierBody := constant.VerifierString(message)
-	verifierHash := sha256.Sum256(verifierBody)
-
 	publicKey, err := getPublicKey(message.Agent, message.KeyID)
 	if err != nil {
 		log.Debug("Error retrieving public key", err)
 		return err
 	}
 
-	signature, err := hex.DecodeString(message.Signature)
-	if err != nil {
-		log.Debug("Error decoding hex string", err)
-		return err
+	// The declared algorithm must match the published key to prevent downgrades
+	alg := message.Alg
+	if alg == "" {
+		alg = constant.KeyAlgorithmRSA
+	}
+	if alg != publicKey.Algorithm {
+		log.Warn(fmt.Sprintf("Message algorithm '%s' does not match key '%s' from agent '%s'", alg, message.KeyID, message.Agent))
+		return fmt.Errorf("algorithm '%s' does not match published key algorithm '%s'", alg, publicKey.Algorithm)
 	}
 
 	// Verify the message signature with the public key
-	err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, verifierHash[:], signature)
+	err = verifyBytes(publicKey, constant.VerifierString(message), message.Signature)
 	if err != nil {
 		log.Warn(fmt.Sprintf("Key '%s' from agent '%s' is not signed by a trusted source", message.KeyID, message.Agent))
 		return err
 	}
 
-	return nil
+	// Only pin or check keys once the signature has been proven
+	return checkTrust(message.Agent, message.KeyID, publicKey)
 }
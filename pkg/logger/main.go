@@ -23,18 +23,27 @@ func Init() {
 
 	log.SetOutput(os.Stdout)
 
+	insightsHook := &insights.InsightsHook{}
+
+	SetLevel(config.GetConfig().Agent.LogLevel)
+	log.AddHook(insightsHook)
+
+	config.OnChange(func(cfg config.Config) {
+		SetLevel(cfg.Agent.LogLevel)
+	})
+}
+
+// SetLevel sets the log level by its name in the configuration
+func SetLevel(level string) {
 	var logLevel log.Level
-	switch config.GetConfig().Agent.LogLevel {
+	switch level {
 	case "debug":
 		logLevel = log.DebugLevel
 	default:
 		logLevel = log.InfoLevel
 	}
 
-	insightsHook := &insights.InsightsHook{}
-
 	log.SetLevel(logLevel)
-	log.AddHook(insightsHook)
 }
 
 func SetApp(a string) {
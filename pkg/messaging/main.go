@@ -9,13 +9,15 @@ import (
 	"github.com/willhackett/azure-mft/pkg/keys"
 )
 
-func SendMessage(id string, messageType string, payload []byte, destinationAgent string) error {
+// SendMessage signs a message and sends it to the queue of destinationAgent
+// for priority
+func SendMessage(id string, messageType string, payload []byte, destinationAgent string, priority string) error {
 	var err error
 	var body []byte
 
 	message := &constant.Message{
 		ID:      id,
-		KeyID:   config.GetKeys().KeyID,
+		KeyID:   keys.GetProvider().KeyID(),
 		Agent:   config.GetConfig().Agent.Name,
 		Type:    messageType,
 		Payload: payload,
@@ -29,5 +31,7 @@ func SendMessage(id string, messageType string, payload []byte, destinationAgent
 		return err
 	}
 
-	return azure.PostMessage(destinationAgent, string(body))
+	ttl := config.GetConfig().Daemon.ForType(messageType).MessageTTL
+
+	return azure.PostMessage(azure.PriorityQueueName(destinationAgent, priority), string(body), ttl)
 }
@@ -0,0 +1,55 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+var (
+	log = logger.Get().WithFields(logrus.Fields{
+		"event": "Policy",
+	})
+
+	decisionLock sync.Mutex
+)
+
+// record appends a decision to the decision log as a line of JSON and logs
+// the explanation of rejects
+func record(decision Decision) {
+	if !decision.Allowed {
+		log.WithField("id", decision.ID).Warn(fmt.Sprintf("Rejected %s of %s with agent %s: %s (%s)", decision.Direction, decision.FileName, decision.Agent, decision.Reason, decision.Detail))
+	}
+
+	decisionBytes, err := json.Marshal(decision)
+	if err != nil {
+		log.Error("Cannot encode policy decision", err)
+		return
+	}
+
+	decisionLock.Lock()
+	defer decisionLock.Unlock()
+
+	fileName := config.GetConfig().Policy.DecisionLog
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		log.Error("Cannot create decision log directory", err)
+		return
+	}
+
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error("Cannot open decision log", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(decisionBytes, '\n')); err != nil {
+		log.Error("Cannot write decision log", err)
+	}
+}
@@ -0,0 +1,160 @@
+package policy
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+// Decision is the outcome of evaluating a transfer against the policy.
+// Rule is the index of the rule that applied, or -1 when none did.
+type Decision struct {
+	Time      time.Time `json:"time"`
+	ID        string    `json:"id"`
+	Agent     string    `json:"agent"`
+	Direction string    `json:"direction"`
+	FileName  string    `json:"file_name,omitempty"`
+	FileSize  int64     `json:"file_size"`
+	Allowed   bool      `json:"allowed"`
+	Rule      int       `json:"rule"`
+	Reason    string    `json:"reason,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// findRule returns the first rule for the peer and direction. A rule for
+// peer '*' applies to every agent.
+func findRule(agentName string, direction string) (int, *config.PolicyRule) {
+	rules := config.GetConfig().Policy.Rules
+	for i := range rules {
+		if rules[i].Direction != direction {
+			continue
+		}
+		if rules[i].Peer == agentName || rules[i].Peer == "*" {
+			return i, &rules[i]
+		}
+	}
+	return -1, nil
+}
+
+// matchPath matches a path against a pattern. Patterns ending in '/**' match
+// everything beneath the directory, other patterns use filepath.Match.
+func matchPath(pattern string, fileName string) bool {
+	if strings.HasSuffix(pattern, "/**") {
+		dir := strings.TrimSuffix(pattern, "/**")
+		return strings.HasPrefix(fileName, dir+string(filepath.Separator))
+	}
+	matched, err := filepath.Match(pattern, fileName)
+	return err == nil && matched
+}
+
+func matchAnyPath(patterns []string, fileName string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, fileName) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchExtension(extensions []string, fileName string) bool {
+	extension := filepath.Ext(fileName)
+	for _, allowed := range extensions {
+		if !strings.HasPrefix(allowed, ".") {
+			allowed = "." + allowed
+		}
+		if strings.EqualFold(allowed, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// inWindow reports whether now falls in one of the time of day windows
+func inWindow(windows []string, now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range windows {
+		start, end, err := constant.ParseTimeWindow(window)
+		if err != nil {
+			continue
+		}
+		if start <= end && minute >= start && minute < end {
+			return true
+		}
+		if start > end && (minute >= start || minute < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate checks a transfer with a peer against the policy, records the
+// decision and counts allowed transfers towards the daily quota of the peer
+func Evaluate(id string, agentName string, direction string, fileName string, fileSize int64) Decision {
+	now := time.Now()
+	decision := Decision{
+		Time:      now,
+		ID:        id,
+		Agent:     agentName,
+		Direction: direction,
+		FileName:  fileName,
+		FileSize:  fileSize,
+		Rule:      -1,
+	}
+
+	index, rule := findRule(agentName, direction)
+	decision.Rule = index
+
+	switch {
+	case rule == nil:
+		if config.GetConfig().Policy.Default == constant.PolicyDefaultDeny {
+			decision.Reason = constant.RejectReasonNotAllowed
+			decision.Detail = fmt.Sprintf("no %s rule for agent and the default is deny", direction)
+		}
+	case len(rule.Paths) > 0 && !matchAnyPath(rule.Paths, fileName):
+		decision.Reason = constant.RejectReasonNotAllowed
+		decision.Detail = fmt.Sprintf("path does not match any of %s", strings.Join(rule.Paths, ", "))
+	case len(rule.Extensions) > 0 && !matchExtension(rule.Extensions, fileName):
+		decision.Reason = constant.RejectReasonNotAllowed
+		decision.Detail = fmt.Sprintf("extension is not one of %s", strings.Join(rule.Extensions, ", "))
+	case rule.MaxFileSize > 0 && fileSize > rule.MaxFileSize:
+		decision.Reason = constant.RejectReasonFileTooLarge
+		decision.Detail = fmt.Sprintf("file size %d exceeds the maximum of %d bytes", fileSize, rule.MaxFileSize)
+	case len(rule.Windows) > 0 && !inWindow(rule.Windows, now):
+		decision.Reason = constant.RejectReasonOutsideWindow
+		decision.Detail = fmt.Sprintf("%s is outside of %s", now.Format("15:04"), strings.Join(rule.Windows, ", "))
+	default:
+		if err := reserveQuota(id, agentName, direction, fileSize, rule, now); err != nil {
+			decision.Reason = constant.RejectReasonQuotaExceeded
+			decision.Detail = err.Error()
+		}
+	}
+
+	decision.Allowed = decision.Reason == ""
+	record(decision)
+	return decision
+}
+
+// Release gives back the quota counted for an allowed transfer that did not
+// go ahead, such as one vetoed by an exit
+func Release(id string, agentName string, direction string, fileSize int64) {
+	releaseQuota(id, agentName, direction, fileSize, time.Now())
+}
+
+// Reject records a transfer that was rejected before the policy was
+// evaluated, such as by the allow lists or the path sandbox
+func Reject(id string, agentName string, direction string, fileName string, reason string, detail string) {
+	record(Decision{
+		Time:      time.Now(),
+		ID:        id,
+		Agent:     agentName,
+		Direction: direction,
+		FileName:  fileName,
+		Rule:      -1,
+		Reason:    reason,
+		Detail:    detail,
+	})
+}
@@ -0,0 +1,219 @@
+package policy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+// usePolicy configures a policy with its state kept in a temporary directory
+func usePolicy(t *testing.T, policy config.PolicyConf) {
+	dir := t.TempDir()
+
+	policy.DecisionLog = filepath.Join(dir, "decisions.log")
+	cfg := config.Config{Policy: policy}
+	cfg.Paths.CacheDir = dir
+
+	config.Set(cfg)
+	t.Cleanup(func() { config.Set(config.Config{}) })
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		fileName string
+		want     bool
+	}{
+		{"/data/in/**", "/data/in/file.csv", true},
+		{"/data/in/**", "/data/in/sub/file.csv", true},
+		{"/data/in/**", "/data/in", false},
+		{"/data/in/**", "/data/inbox/file.csv", false},
+		{"/data/in/*.csv", "/data/in/file.csv", true},
+		{"/data/in/*.csv", "/data/in/sub/file.csv", false},
+		{"/data/in/*.csv", "/data/in/file.txt", false},
+		{"/data/in/file.csv", "/data/in/file.csv", true},
+		{"[", "/data/in/file.csv", false},
+	}
+
+	for _, test := range tests {
+		if got := matchPath(test.pattern, test.fileName); got != test.want {
+			t.Errorf("matchPath(%q, %q) = %v, want %v", test.pattern, test.fileName, got, test.want)
+		}
+	}
+}
+
+func TestMatchExtension(t *testing.T) {
+	tests := []struct {
+		extensions []string
+		fileName   string
+		want       bool
+	}{
+		{[]string{".csv"}, "/data/file.csv", true},
+		{[]string{"csv"}, "/data/file.csv", true},
+		{[]string{".CSV"}, "/data/file.csv", true},
+		{[]string{".csv"}, "/data/file.CSV", true},
+		{[]string{".csv", ".txt"}, "/data/file.txt", true},
+		{[]string{".csv"}, "/data/file.csv.exe", false},
+		{[]string{".csv"}, "/data/csv", false},
+	}
+
+	for _, test := range tests {
+		if got := matchExtension(test.extensions, test.fileName); got != test.want {
+			t.Errorf("matchExtension(%v, %q) = %v, want %v", test.extensions, test.fileName, got, test.want)
+		}
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		windows []string
+		now     time.Time
+		want    bool
+	}{
+		{[]string{"08:00-18:00"}, at(8, 0), true},
+		{[]string{"08:00-18:00"}, at(17, 59), true},
+		{[]string{"08:00-18:00"}, at(18, 0), false},
+		{[]string{"08:00-18:00"}, at(7, 59), false},
+		{[]string{"22:00-06:00"}, at(23, 0), true},
+		{[]string{"22:00-06:00"}, at(5, 59), true},
+		{[]string{"22:00-06:00"}, at(6, 0), false},
+		{[]string{"22:00-06:00"}, at(12, 0), false},
+		{[]string{"01:00-02:00", "13:00-14:00"}, at(13, 30), true},
+		{[]string{"not a window"}, at(13, 30), false},
+	}
+
+	for _, test := range tests {
+		if got := inWindow(test.windows, test.now); got != test.want {
+			t.Errorf("inWindow(%v, %s) = %v, want %v", test.windows, test.now.Format("15:04"), got, test.want)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	rules := []config.PolicyRule{
+		{Peer: "partner", Direction: constant.PolicyDirectionReceive, Paths: []string{"/data/in/**"}, Extensions: []string{".csv"}, MaxFileSize: 100},
+		{Peer: "*", Direction: constant.PolicyDirectionServe, Paths: []string{"/data/out/**"}},
+	}
+
+	tests := []struct {
+		name       string
+		policy     config.PolicyConf
+		agent      string
+		direction  string
+		fileName   string
+		fileSize   int64
+		wantReason string
+		wantRule   int
+	}{
+		{"allowed by rule", config.PolicyConf{Rules: rules}, "partner", constant.PolicyDirectionReceive, "/data/in/file.csv", 10, "", 0},
+		{"path outside rule", config.PolicyConf{Rules: rules}, "partner", constant.PolicyDirectionReceive, "/data/out/file.csv", 10, constant.RejectReasonNotAllowed, 0},
+		{"extension outside rule", config.PolicyConf{Rules: rules}, "partner", constant.PolicyDirectionReceive, "/data/in/file.exe", 10, constant.RejectReasonNotAllowed, 0},
+		{"file too large", config.PolicyConf{Rules: rules}, "partner", constant.PolicyDirectionReceive, "/data/in/file.csv", 101, constant.RejectReasonFileTooLarge, 0},
+		{"rule for every agent", config.PolicyConf{Rules: rules}, "other", constant.PolicyDirectionServe, "/data/out/file.csv", 10, "", 1},
+		{"no rule with default allow", config.PolicyConf{Rules: rules, Default: constant.PolicyDefaultAllow}, "other", constant.PolicyDirectionReceive, "/data/in/file.csv", 10, "", -1},
+		{"no rule with default deny", config.PolicyConf{Rules: rules, Default: constant.PolicyDefaultDeny}, "other", constant.PolicyDirectionReceive, "/data/in/file.csv", 10, constant.RejectReasonNotAllowed, -1},
+		{"outside window", config.PolicyConf{Rules: []config.PolicyRule{{Peer: "*", Direction: constant.PolicyDirectionReceive, Windows: []string{"00:00-00:00"}}}}, "partner", constant.PolicyDirectionReceive, "/data/in/file.csv", 10, constant.RejectReasonOutsideWindow, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usePolicy(t, test.policy)
+
+			decision := Evaluate("id", test.agent, test.direction, test.fileName, test.fileSize)
+			if decision.Reason != test.wantReason {
+				t.Errorf("Evaluate() reason = %q (%s), want %q", decision.Reason, decision.Detail, test.wantReason)
+			}
+			if decision.Allowed != (test.wantReason == "") {
+				t.Errorf("Evaluate() allowed = %v with reason %q", decision.Allowed, decision.Reason)
+			}
+			if decision.Rule != test.wantRule {
+				t.Errorf("Evaluate() rule = %d, want %d", decision.Rule, test.wantRule)
+			}
+		})
+	}
+}
+
+func TestQuota(t *testing.T) {
+	type transfer struct {
+		id        string
+		agent     string
+		fileSize  int64
+		release   bool
+		wantAllow bool
+	}
+
+	tests := []struct {
+		name      string
+		rule      config.PolicyRule
+		transfers []transfer
+	}{
+		{
+			name: "daily files",
+			rule: config.PolicyRule{Peer: "*", Direction: constant.PolicyDirectionReceive, DailyFiles: 2},
+			transfers: []transfer{
+				{id: "a", agent: "partner", fileSize: 1, wantAllow: true},
+				{id: "b", agent: "partner", fileSize: 1, wantAllow: true},
+				{id: "c", agent: "partner", fileSize: 1, wantAllow: false},
+			},
+		},
+		{
+			name: "daily bytes",
+			rule: config.PolicyRule{Peer: "*", Direction: constant.PolicyDirectionReceive, DailyBytes: 100},
+			transfers: []transfer{
+				{id: "a", agent: "partner", fileSize: 60, wantAllow: true},
+				{id: "b", agent: "partner", fileSize: 41, wantAllow: false},
+				{id: "c", agent: "partner", fileSize: 40, wantAllow: true},
+			},
+		},
+		{
+			name: "redelivered transfer counts once",
+			rule: config.PolicyRule{Peer: "*", Direction: constant.PolicyDirectionReceive, DailyFiles: 1},
+			transfers: []transfer{
+				{id: "a", agent: "partner", fileSize: 1, wantAllow: true},
+				{id: "a", agent: "partner", fileSize: 1, wantAllow: true},
+				{id: "b", agent: "partner", fileSize: 1, wantAllow: false},
+			},
+		},
+		{
+			name: "released transfer gives back its quota",
+			rule: config.PolicyRule{Peer: "*", Direction: constant.PolicyDirectionReceive, DailyFiles: 1},
+			transfers: []transfer{
+				{id: "a", agent: "partner", fileSize: 1, release: true, wantAllow: true},
+				{id: "b", agent: "partner", fileSize: 1, wantAllow: true},
+				{id: "c", agent: "partner", fileSize: 1, wantAllow: false},
+			},
+		},
+		{
+			name: "each agent has its own quota",
+			rule: config.PolicyRule{Peer: "*", Direction: constant.PolicyDirectionReceive, DailyFiles: 1},
+			transfers: []transfer{
+				{id: "a", agent: "partner", fileSize: 1, wantAllow: true},
+				{id: "b", agent: "other", fileSize: 1, wantAllow: true},
+				{id: "c", agent: "partner", fileSize: 1, wantAllow: false},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usePolicy(t, config.PolicyConf{Rules: []config.PolicyRule{test.rule}})
+
+			for i, transfer := range test.transfers {
+				decision := Evaluate(transfer.id, transfer.agent, constant.PolicyDirectionReceive, "/data/in/file.csv", transfer.fileSize)
+				if decision.Allowed != transfer.wantAllow {
+					t.Fatalf("transfer %d (%s) allowed = %v (%s), want %v", i, transfer.id, decision.Allowed, decision.Detail, transfer.wantAllow)
+				}
+				if transfer.release {
+					Release(transfer.id, transfer.agent, constant.PolicyDirectionReceive, transfer.fileSize)
+				}
+			}
+		})
+	}
+}
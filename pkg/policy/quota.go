@@ -0,0 +1,129 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+)
+
+const (
+	quotaFileName = "quotas.json"
+)
+
+// usage counts what a peer transferred in one direction on a day
+type usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+// quotaState holds the usage of the day and the transfers counted in it, so
+// that a redelivered message is not counted twice
+type quotaState struct {
+	Date     string            `json:"date"`
+	Usage    map[string]*usage `json:"usage"`
+	Reserved map[string]bool   `json:"reserved,omitempty"`
+}
+
+var quotaLock sync.Mutex
+
+func quotaFile() string {
+	return filepath.Join(config.GetConfig().Paths.CacheDir, quotaFileName)
+}
+
+func loadQuotaState(date string) *quotaState {
+	state := &quotaState{}
+
+	stateBytes, err := ioutil.ReadFile(quotaFile())
+	if err == nil {
+		if err := json.Unmarshal(stateBytes, state); err != nil {
+			log.Warn("Daily quota usage is unreadable and has been reset", err)
+		}
+	}
+
+	if state.Date != date || state.Usage == nil {
+		return &quotaState{Date: date, Usage: map[string]*usage{}, Reserved: map[string]bool{}}
+	}
+	if state.Reserved == nil {
+		state.Reserved = map[string]bool{}
+	}
+	return state
+}
+
+func saveQuotaState(state *quotaState) error {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.GetConfig().Paths.CacheDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(quotaFile(), stateBytes, 0600)
+}
+
+// reserveQuota counts a transfer towards the daily quotas of the rule, or
+// returns an error when it would exceed them. Usage is kept per peer, so a
+// rule for '*' gives every agent its own quota. A transfer is only counted
+// once per direction.
+func reserveQuota(id string, agentName string, direction string, fileSize int64, rule *config.PolicyRule, now time.Time) error {
+	if rule.DailyBytes <= 0 && rule.DailyFiles <= 0 {
+		return nil
+	}
+
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	state := loadQuotaState(now.Format("2006-01-02"))
+	key := agentName + "/" + direction
+	if state.Reserved[id+"/"+direction] {
+		return nil
+	}
+	used, ok := state.Usage[key]
+	if !ok {
+		used = &usage{}
+		state.Usage[key] = used
+	}
+
+	if rule.DailyFiles > 0 && used.Files+1 > rule.DailyFiles {
+		return fmt.Errorf("daily quota of %d files is used up", rule.DailyFiles)
+	}
+	if rule.DailyBytes > 0 && used.Bytes+fileSize > rule.DailyBytes {
+		return fmt.Errorf("%d bytes would exceed the daily quota of %d bytes, %d used", fileSize, rule.DailyBytes, used.Bytes)
+	}
+
+	used.Files++
+	used.Bytes += fileSize
+	state.Reserved[id+"/"+direction] = true
+
+	if err := saveQuotaState(state); err != nil {
+		log.Error("Cannot save daily quota usage", err)
+	}
+	return nil
+}
+
+// releaseQuota gives back what a transfer counted towards the quotas of the
+// day, if it counted any
+func releaseQuota(id string, agentName string, direction string, fileSize int64, now time.Time) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	state := loadQuotaState(now.Format("2006-01-02"))
+	if !state.Reserved[id+"/"+direction] {
+		return
+	}
+	delete(state.Reserved, id+"/"+direction)
+
+	if used, ok := state.Usage[agentName+"/"+direction]; ok {
+		used.Files--
+		used.Bytes -= fileSize
+	}
+
+	if err := saveQuotaState(state); err != nil {
+		log.Error("Cannot save daily quota usage", err)
+	}
+}
@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+const approvalFileName = "approvals.json"
+
+// Approval is a handshake this agent accepted. The file available message of
+// the transfer may only write the approved path, up to the approved size.
+type Approval struct {
+	Agent      string `json:"agent"`
+	FileName   string `json:"file_name"`
+	FileSize   int64  `json:"file_size"`
+	Expiration int64  `json:"expiration"`
+}
+
+// Approvals are kept on disk as the upload may outlast a restart of the daemon
+func approvalFile() string {
+	return filepath.Join(config.GetConfig().Paths.CacheDir, approvalFileName)
+}
+
+func loadApprovals() map[string]Approval {
+	approvals := map[string]Approval{}
+
+	approvalBytes, err := ioutil.ReadFile(approvalFile())
+	if err == nil {
+		json.Unmarshal(approvalBytes, &approvals)
+	}
+
+	now := time.Now().Unix()
+	for id, approval := range approvals {
+		if approval.Expiration < now {
+			delete(approvals, id)
+		}
+	}
+	return approvals
+}
+
+func saveApprovals(approvals map[string]Approval) error {
+	approvalBytes, err := json.Marshal(approvals)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.GetConfig().Paths.CacheDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(approvalFile(), approvalBytes, 0600)
+}
+
+// AddApproval records an accepted handshake. A redelivered handshake replaces
+// the approval of the same transfer.
+func AddApproval(id string, agentName string, fileName string, fileSize int64) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	approvals := loadApprovals()
+	approvals[id] = Approval{
+		Agent:      agentName,
+		FileName:   fileName,
+		FileSize:   fileSize,
+		Expiration: time.Now().Add(constant.ApprovalExpiry).Unix(),
+	}
+	return saveApprovals(approvals)
+}
+
+func GetApproval(id string) (Approval, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	approval, ok := loadApprovals()[id]
+	return approval, ok
+}
+
+func DeleteApproval(id string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	approvals := loadApprovals()
+	if _, ok := approvals[id]; !ok {
+		return nil
+	}
+	delete(approvals, id)
+	return saveApprovals(approvals)
+}
@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"sync"
 	"time"
 
 	"github.com/willhackett/azure-mft/pkg/constant"
@@ -11,38 +12,88 @@ const (
 )
 
 type Transfer struct {
-	ID         string
-	Details    constant.FileRequestMessage
+	ID      string
+	Details constant.FileRequestMessage
+	// FileSize and ModTime identify the version of the source file requested
+	FileSize   int64
+	ModTime    int64
 	Expiration int64
 }
 
 var (
 	transfers = make(map[string]Transfer)
+
+	// lock guards transfers, which handlers use from several workers
+	lock sync.Mutex
+
+	onExpire func(Transfer)
 )
 
-func AddTransfer(id string, obj constant.FileRequestMessage, expiresIn int64) {
+// OnExpire sets a handler called with each transfer that expires
+func OnExpire(handler func(Transfer)) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	onExpire = handler
+}
+
+func AddTransfer(id string, obj constant.FileRequestMessage, fileSize int64, modTime int64, expiresIn int64) {
+	lock.Lock()
+	defer lock.Unlock()
+
 	transfers[id] = Transfer{
 		ID:         id,
 		Details:    obj,
+		FileSize:   fileSize,
+		ModTime:    modTime,
 		Expiration: time.Now().Add(time.Duration(expiresIn) * time.Second).Unix(),
 	}
 }
 
+// Touch extends the expiry of a transfer that is making progress
+func Touch(id string, expiresIn int64) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if t, ok := transfers[id]; ok {
+		t.Expiration = time.Now().Add(time.Duration(expiresIn) * time.Second).Unix()
+		transfers[id] = t
+	}
+}
+
 func DeleteTransfer(id string) {
+	lock.Lock()
+	defer lock.Unlock()
+
 	delete(transfers, id)
 }
 
 func GetTransfer(id string) (Transfer, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
 	t, ok := transfers[id]
 	return t, ok
 }
 
 func DeleteExpired() {
+	lock.Lock()
+	expired := []Transfer{}
 	for id, t := range transfers {
 		if t.Expiration > 0 && t.Expiration < time.Now().Unix() {
 			delete(transfers, id)
+			expired = append(expired, t)
 		}
 	}
+	handler := onExpire
+	lock.Unlock()
+
+	if handler == nil {
+		return
+	}
+	for _, t := range expired {
+		handler(t)
+	}
 }
 
 func init() {
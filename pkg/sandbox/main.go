@@ -0,0 +1,123 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+)
+
+const (
+	// DefaultPeer holds the roots of agents without their own peers entry
+	DefaultPeer = "*"
+)
+
+// ErrNotAllowed is returned when a path lies outside the roots allowed for a peer
+var ErrNotAllowed = errors.New("path is outside the roots allowed for this agent")
+
+// peerConf returns the roots configured for an agent, falling back to the
+// default peer. Viper lowercases map keys, so the lookup is case-insensitive.
+func peerConf(agentName string) config.PeerConf {
+	peers := config.GetConfig().Peers
+	if peer, ok := peers[strings.ToLower(agentName)]; ok {
+		return peer
+	}
+	return peers[DefaultPeer]
+}
+
+// hasTraversal reports whether any element of the path is '..'
+func hasTraversal(fileName string) bool {
+	for _, element := range strings.Split(filepath.ToSlash(fileName), "/") {
+		if element == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// realPath resolves symlinks in the deepest existing ancestor of fileName and
+// appends the elements that do not exist yet. A dangling symlink is refused
+// since writing to it would create its target.
+func realPath(fileName string) (string, error) {
+	existing := filepath.Clean(fileName)
+	missing := []string{}
+
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, err := os.Lstat(existing); err == nil {
+			return "", fmt.Errorf("%s is a dangling symlink", existing)
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return "", err
+		}
+		missing = append([]string{filepath.Base(existing)}, missing...)
+		existing = parent
+	}
+}
+
+// within reports whether fileName is root or lies beneath it
+func within(fileName string, root string) bool {
+	relative, err := filepath.Rel(root, fileName)
+	if err != nil {
+		return false
+	}
+	return relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// Resolve returns the real path of fileName when it is absolute, free of '..'
+// elements and, once symlinks are resolved, inside one of roots
+func Resolve(fileName string, roots []string) (string, error) {
+	if !filepath.IsAbs(fileName) || hasTraversal(fileName) {
+		return "", ErrNotAllowed
+	}
+
+	resolved, err := realPath(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range roots {
+		resolvedRoot, err := realPath(root)
+		if err != nil {
+			continue
+		}
+		if within(resolved, resolvedRoot) {
+			return resolved, nil
+		}
+	}
+	return "", ErrNotAllowed
+}
+
+// Enabled reports whether paths are sandboxed. Configurations without a
+// peers section keep the behaviour from before sandboxing, where any path is
+// allowed, and are warned about.
+func Enabled() bool {
+	return len(config.GetConfig().Peers) > 0
+}
+
+// ReceivePath resolves a path that agentName asks this agent to write to
+func ReceivePath(agentName string, fileName string) (string, error) {
+	if !Enabled() {
+		return fileName, nil
+	}
+	return Resolve(fileName, peerConf(agentName).ReceiveRoots)
+}
+
+// ServePath resolves a path that agentName asks this agent to read from
+func ServePath(agentName string, fileName string) (string, error) {
+	if !Enabled() {
+		return fileName, nil
+	}
+	return Resolve(fileName, peerConf(agentName).ServeRoots)
+}
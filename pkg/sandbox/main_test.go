@@ -0,0 +1,174 @@
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+)
+
+// tree creates a root with a file, a directory of files outside it and links
+// from inside the root to both, resolving the temporary directory itself so
+// that resolved paths can be compared
+func tree(t *testing.T) (root string, outside string) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.Join(dir, "root")
+	outside = filepath.Join(dir, "outside")
+
+	for _, d := range []string{filepath.Join(root, "in"), outside, filepath.Join(dir, "rootx")} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "in", "file"), filepath.Join(outside, "secret")} {
+		if err := ioutil.WriteFile(f, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		filepath.Join(root, "escape"):   outside,
+		filepath.Join(root, "inner"):    filepath.Join(root, "in"),
+		filepath.Join(root, "dangling"): filepath.Join(outside, "missing"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skip("symlinks are not supported:", err)
+		}
+	}
+	return root, outside
+}
+
+func TestResolve(t *testing.T) {
+	root, outside := tree(t)
+
+	tests := []struct {
+		name     string
+		fileName string
+		want     string
+		wantErr  bool
+	}{
+		{"file in root", filepath.Join(root, "in", "file"), filepath.Join(root, "in", "file"), false},
+		{"new file in root", filepath.Join(root, "in", "new"), filepath.Join(root, "in", "new"), false},
+		{"new directories in root", filepath.Join(root, "a", "b", "new"), filepath.Join(root, "a", "b", "new"), false},
+		{"root itself", root, root, false},
+		{"link within root", filepath.Join(root, "inner", "file"), filepath.Join(root, "in", "file"), false},
+		{"relative path", filepath.Join("root", "in", "file"), "", true},
+		{"traversal out of root", filepath.Join(root, "in", "..", "..", "outside", "secret"), "", true},
+		{"traversal within root", root + "/in/../in/file", "", true},
+		{"file outside root", filepath.Join(outside, "secret"), "", true},
+		{"sibling sharing the root prefix", filepath.Join(filepath.Dir(root), "rootx", "file"), "", true},
+		{"link out of root", filepath.Join(root, "escape", "secret"), "", true},
+		{"new file through link out of root", filepath.Join(root, "escape", "new"), "", true},
+		{"dangling link", filepath.Join(root, "dangling"), "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Resolve(test.fileName, []string{root})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Resolve(%s) error = %v, want error %v", test.fileName, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("Resolve(%s) = %s, want %s", test.fileName, got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveWithoutRoots(t *testing.T) {
+	root, _ := tree(t)
+
+	if _, err := Resolve(filepath.Join(root, "in", "file"), nil); err != ErrNotAllowed {
+		t.Errorf("Resolve() without roots error = %v, want %v", err, ErrNotAllowed)
+	}
+}
+
+func TestPeerRoots(t *testing.T) {
+	root, outside := tree(t)
+	file := filepath.Join(root, "in", "file")
+	secret := filepath.Join(outside, "secret")
+
+	tests := []struct {
+		name    string
+		peers   map[string]config.PeerConf
+		agent   string
+		receive string
+		serve   string
+		wantErr bool
+	}{
+		{
+			name:    "no peers section leaves paths unsandboxed",
+			agent:   "agent",
+			receive: secret,
+			serve:   secret,
+		},
+		{
+			name:    "own entry",
+			peers:   map[string]config.PeerConf{"agent": {ReceiveRoots: []string{root}, ServeRoots: []string{root}}},
+			agent:   "agent",
+			receive: file,
+			serve:   file,
+		},
+		{
+			name:    "entries are matched without case",
+			peers:   map[string]config.PeerConf{"agent": {ReceiveRoots: []string{root}, ServeRoots: []string{root}}},
+			agent:   "Agent",
+			receive: file,
+			serve:   file,
+		},
+		{
+			name:    "default entry",
+			peers:   map[string]config.PeerConf{DefaultPeer: {ReceiveRoots: []string{root}, ServeRoots: []string{root}}},
+			agent:   "agent",
+			receive: file,
+			serve:   file,
+		},
+		{
+			name:    "own entry replaces the default entry",
+			peers:   map[string]config.PeerConf{"agent": {ServeRoots: []string{outside}}, DefaultPeer: {ReceiveRoots: []string{root}, ServeRoots: []string{root}}},
+			agent:   "agent",
+			receive: file,
+			wantErr: true,
+		},
+		{
+			name:    "no entry for the agent",
+			peers:   map[string]config.PeerConf{"other": {ReceiveRoots: []string{root}, ServeRoots: []string{root}}},
+			agent:   "agent",
+			receive: file,
+			serve:   file,
+			wantErr: true,
+		},
+		{
+			name:    "outside the roots",
+			peers:   map[string]config.PeerConf{DefaultPeer: {ReceiveRoots: []string{root}, ServeRoots: []string{root}}},
+			agent:   "agent",
+			receive: secret,
+			serve:   secret,
+			wantErr: true,
+		},
+	}
+
+	defer config.Set(config.Config{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Set(config.Config{Peers: test.peers})
+
+			if test.receive != "" {
+				if _, err := ReceivePath(test.agent, test.receive); (err != nil) != test.wantErr {
+					t.Errorf("ReceivePath(%s) error = %v, want error %v", test.receive, err, test.wantErr)
+				}
+			}
+			if test.serve != "" {
+				if _, err := ServePath(test.agent, test.serve); (err != nil) != test.wantErr {
+					t.Errorf("ServePath(%s) error = %v, want error %v", test.serve, err, test.wantErr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package schedule
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+)
+
+const (
+	stateFileName   = "schedules.json"
+	historyFileName = "schedule-history.log"
+)
+
+// Record is the record of one run of a schedule in the history
+type Record struct {
+	Schedule    string    `json:"schedule"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Status      string    `json:"status"`
+	Files       []string  `json:"files,omitempty"`
+	CatchUp     bool      `json:"catch_up,omitempty"`
+	Missed      int       `json:"missed,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// scheduleState is what is kept of a schedule between restarts
+type scheduleState struct {
+	LastRun time.Time `json:"last_run"`
+}
+
+var stateLock sync.Mutex
+
+func stateFile() string {
+	return filepath.Join(config.GetConfig().Paths.CacheDir, stateFileName)
+}
+
+func historyFile() string {
+	return filepath.Join(config.GetConfig().Paths.CacheDir, historyFileName)
+}
+
+// LoadState returns when each schedule last ran, keyed by name
+func LoadState() map[string]scheduleState {
+	state := map[string]scheduleState{}
+
+	stateBytes, err := ioutil.ReadFile(stateFile())
+	if err == nil {
+		if err := json.Unmarshal(stateBytes, &state); err != nil {
+			log.Warn("Schedule state is unreadable and has been reset", err)
+		}
+	}
+	return state
+}
+
+func saveState(state map[string]scheduleState) error {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.GetConfig().Paths.CacheDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stateFile(), stateBytes, 0600)
+}
+
+// setLastRun records when a schedule last ran
+func setLastRun(name string, at time.Time) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	// A run that finishes after a later one was skipped does not move it back
+	state := LoadState()
+	if state[name].LastRun.After(at) {
+		return
+	}
+	state[name] = scheduleState{LastRun: at}
+	if err := saveState(state); err != nil {
+		log.Error("Cannot save schedule state", err)
+	}
+}
+
+// register records schedules that have no state yet as last run at now, so
+// that runs missed from then on are caught up after downtime
+func register(schedules []config.ScheduleConf, now time.Time) map[string]scheduleState {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+
+	state := LoadState()
+	changed := false
+	for _, schedule := range schedules {
+		if _, ok := state[schedule.Name]; !ok {
+			state[schedule.Name] = scheduleState{LastRun: now}
+			changed = true
+		}
+	}
+	if changed {
+		if err := saveState(state); err != nil {
+			log.Error("Cannot save schedule state", err)
+		}
+	}
+	return state
+}
+
+var historyLock sync.Mutex
+
+// record appends a run to the history as a line of JSON
+func record(run Record) {
+	runBytes, err := json.Marshal(run)
+	if err != nil {
+		log.Error("Cannot encode schedule run", err)
+		return
+	}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	if err := os.MkdirAll(config.GetConfig().Paths.CacheDir, 0700); err != nil {
+		log.Error("Cannot create schedule history directory", err)
+		return
+	}
+
+	file, err := os.OpenFile(historyFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error("Cannot open schedule history", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(runBytes, '\n')); err != nil {
+		log.Error("Cannot write schedule history", err)
+	}
+}
+
+// History returns the last limit runs, oldest first, of the named schedule or
+// of every schedule when name is empty
+func History(name string, limit int) ([]Record, error) {
+	runs := []Record{}
+
+	file, err := os.Open(historyFile())
+	if os.IsNotExist(err) {
+		return runs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		run := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			continue
+		}
+		if name != "" && run.Schedule != name {
+			continue
+		}
+		runs = append(runs, run)
+		if limit > 0 && len(runs) > limit {
+			runs = runs[1:]
+		}
+	}
+	return runs, scanner.Err()
+}
@@ -0,0 +1,205 @@
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+var log = logger.Get().WithFields(logrus.Fields{
+	"event": "Schedule",
+})
+
+// scheduler runs each schedule at most once at a time
+type scheduler struct {
+	sync.Mutex
+	running map[string]bool
+	runs    sync.WaitGroup
+}
+
+// start runs a schedule in the background unless its previous run is still
+// going
+func (s *scheduler) start(schedule config.ScheduleConf, scheduledAt time.Time, missed int) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.running[schedule.Name] {
+		log.WithField("schedule", schedule.Name).Warn("Skipped scheduled run as the previous run has not finished")
+		record(Record{
+			Schedule:    schedule.Name,
+			ScheduledAt: scheduledAt,
+			StartedAt:   time.Now(),
+			FinishedAt:  time.Now(),
+			Status:      constant.ScheduleRunSkipped,
+			Error:       "previous run has not finished",
+		})
+		setLastRun(schedule.Name, scheduledAt)
+		return
+	}
+	s.running[schedule.Name] = true
+	s.runs.Add(1)
+
+	go func() {
+		defer s.runs.Done()
+		runSchedule(schedule, scheduledAt, missed)
+
+		s.Lock()
+		delete(s.running, schedule.Name)
+		s.Unlock()
+	}()
+}
+
+// catchUp runs once every schedule that missed runs since it last ran, such
+// as while the daemon was stopped. Missed runs are coalesced into one run, as
+// each would send the files matching at the time it is caught up anyway.
+func (s *scheduler) catchUp(now time.Time) {
+	schedules := config.GetConfig().Schedules
+	state := register(schedules, now)
+
+	for _, schedule := range schedules {
+		cronSchedule, err := config.ParseSchedule(schedule)
+		if err != nil {
+			continue
+		}
+
+		missed, lastMissed := missedRuns(cronSchedule, state[schedule.Name].LastRun, now)
+		if missed == 0 {
+			continue
+		}
+
+		if !*schedule.CatchUp {
+			log.WithField("schedule", schedule.Name).Warn(fmt.Sprintf("Not catching up %d missed runs", missed))
+			record(Record{
+				Schedule:    schedule.Name,
+				ScheduledAt: lastMissed,
+				StartedAt:   now,
+				FinishedAt:  now,
+				Status:      constant.ScheduleRunSkipped,
+				Missed:      missed,
+				Error:       "missed while the agent was stopped, catch_up is off",
+			})
+			setLastRun(schedule.Name, lastMissed)
+			continue
+		}
+
+		log.WithField("schedule", schedule.Name).Info(fmt.Sprintf("Catching up %d missed runs", missed))
+		s.start(schedule, lastMissed, missed)
+	}
+}
+
+// missedRuns counts the runs of a schedule due after lastRun and up to now,
+// at most ScheduleCatchUpLimit of them, and returns the latest run due even
+// when there were more
+func missedRuns(cronSchedule cron.Schedule, lastRun time.Time, now time.Time) (int, time.Time) {
+	missed := 0
+	lastMissed := time.Time{}
+	for next := cronSchedule.Next(lastRun); !next.IsZero() && !next.After(now); next = cronSchedule.Next(next) {
+		if missed == constant.ScheduleCatchUpLimit {
+			return missed, latestRun(cronSchedule, next, now)
+		}
+		missed++
+		lastMissed = next
+	}
+	return missed, lastMissed
+}
+
+// latestRun returns the last run of a schedule due up to now, given a run due
+// at from. Rather than walk every run since from, it looks back from now over
+// a doubling span until the span holds a run.
+func latestRun(cronSchedule cron.Schedule, from time.Time, now time.Time) time.Time {
+	start := from
+	for span := time.Minute; now.Add(-span).After(from); span *= 2 {
+		if at := cronSchedule.Next(now.Add(-span)); !at.IsZero() && !at.After(now) {
+			start = at
+			break
+		}
+	}
+
+	latest := start
+	for next := cronSchedule.Next(start); !next.IsZero() && !next.After(now); next = cronSchedule.Next(next) {
+		latest = next
+	}
+	return latest
+}
+
+// due returns the time of the next run of any schedule and the schedules
+// that run then
+func due(now time.Time) (time.Time, []config.ScheduleConf) {
+	next := time.Time{}
+	schedules := []config.ScheduleConf{}
+
+	for _, schedule := range config.GetConfig().Schedules {
+		cronSchedule, err := config.ParseSchedule(schedule)
+		if err != nil {
+			continue
+		}
+
+		at := cronSchedule.Next(now)
+		switch {
+		case at.IsZero():
+		case next.IsZero() || at.Before(next):
+			next = at
+			schedules = []config.ScheduleConf{schedule}
+		case at.Equal(next):
+			schedules = append(schedules, schedule)
+		}
+	}
+	return next, schedules
+}
+
+// Run runs the configured schedules until ctx is done, then waits for runs
+// in progress. Schedules follow configuration reloads.
+func Run(ctx context.Context) {
+	s := &scheduler{running: map[string]bool{}}
+	defer s.runs.Wait()
+
+	changed := make(chan struct{}, 1)
+	config.OnChange(func(cfg config.Config) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	s.catchUp(time.Now())
+
+	for {
+		next, schedules := due(time.Now())
+
+		// Without schedules, wait for a reload that may add some
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-changed:
+			timer.Stop()
+			register(config.GetConfig().Schedules, time.Now())
+		case <-timer.C:
+			for _, schedule := range schedules {
+				s.start(schedule, next, 0)
+			}
+		}
+	}
+}
+
+// NextRun returns when a schedule runs next
+func NextRun(schedule config.ScheduleConf, now time.Time) (time.Time, error) {
+	cronSchedule, err := config.ParseSchedule(schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cronSchedule.Next(now), nil
+}
@@ -0,0 +1,77 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+func TestMissedRuns(t *testing.T) {
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name           string
+		spec           string
+		lastRun        time.Time
+		now            time.Time
+		wantMissed     int
+		wantLastMissed time.Time
+	}{
+		{"no missed runs", "0 * * * *", at(1, 10, 0), at(1, 10, 59), 0, time.Time{}},
+		{"run due now", "0 * * * *", at(1, 10, 0), at(1, 11, 0), 1, at(1, 11, 0)},
+		{"hourly over a few hours", "0 * * * *", at(1, 10, 0), at(1, 13, 30), 3, at(1, 13, 0)},
+		{"daily over a few days", "30 2 * * *", at(1, 2, 30), at(4, 1, 0), 2, at(3, 2, 30)},
+		{"every minute over a long outage", "* * * * *", at(1, 10, 0), at(5, 7, 42), constant.ScheduleCatchUpLimit, at(5, 7, 42)},
+		{"hourly over a long outage", "15 * * * *", at(1, 0, 15), at(1, 23, 10).AddDate(0, 2, 0), constant.ScheduleCatchUpLimit, at(1, 22, 15).AddDate(0, 2, 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cronSchedule, err := cron.ParseStandard(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			missed, lastMissed := missedRuns(cronSchedule, test.lastRun, test.now)
+			if missed != test.wantMissed {
+				t.Errorf("missedRuns() missed = %d, want %d", missed, test.wantMissed)
+			}
+			if !lastMissed.Equal(test.wantLastMissed) {
+				t.Errorf("missedRuns() lastMissed = %s, want %s", lastMissed, test.wantLastMissed)
+			}
+		})
+	}
+}
+
+func TestLatestRun(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		spec string
+		now  time.Time
+		want time.Time
+	}{
+		{"now is from", "0 * * * *", from, from},
+		{"every minute", "* * * * *", from.Add(90*time.Hour + 30*time.Second), from.Add(90 * time.Hour)},
+		{"weekly", "0 9 * * 1", time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)},
+		{"yearly", "0 0 1 1 *", time.Date(2027, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cronSchedule, err := cron.ParseStandard(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := latestRun(cronSchedule, from, test.now); !got.Equal(test.want) {
+				t.Errorf("latestRun() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
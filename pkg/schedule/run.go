@@ -0,0 +1,100 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/tasks"
+)
+
+// matchFiles returns the regular files matching the source of a schedule,
+// leaving out files it has renamed once sent
+func matchFiles(schedule config.ScheduleConf) ([]string, error) {
+	matches, err := filepath.Glob(schedule.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if schedule.SourceAction == constant.SourceActionRename && strings.HasSuffix(match, schedule.RenameSuffix) {
+			continue
+		}
+		files = append(files, match)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// runSchedule sends every file matching the source of a schedule and records
+// the run in the history
+func runSchedule(schedule config.ScheduleConf, scheduledAt time.Time, missed int) {
+	log := log.WithField("schedule", schedule.Name)
+
+	run := Record{
+		Schedule:    schedule.Name,
+		ScheduledAt: scheduledAt,
+		StartedAt:   time.Now(),
+		CatchUp:     missed > 0,
+		Missed:      missed,
+	}
+	defer func() {
+		run.FinishedAt = time.Now()
+		record(run)
+		setLastRun(schedule.Name, scheduledAt)
+	}()
+
+	files, err := matchFiles(schedule)
+	if err != nil {
+		run.Status = constant.ScheduleRunFailed
+		run.Error = err.Error()
+		log.Error("Cannot match schedule source", err)
+		return
+	}
+
+	if len(files) == 0 {
+		run.Status = constant.ScheduleRunSkipped
+		run.Error = fmt.Sprintf("no files match %s", schedule.Source)
+		switch schedule.IfMissing {
+		case constant.ScheduleIfMissingWarn:
+			log.Warn("Scheduled run found no files to send: " + run.Error)
+		case constant.ScheduleIfMissingFail:
+			run.Status = constant.ScheduleRunFailed
+			log.Error("Scheduled run found no files to send: " + run.Error)
+		}
+		return
+	}
+
+	agentName := config.GetConfig().Agent.Name
+	sourceAction := constant.NewSourceAction(schedule.SourceAction, schedule.MoveTo, schedule.RenameSuffix)
+	failed := []string{}
+	for _, fileName := range files {
+		destinationFileName := path.Join(schedule.DestinationPath, filepath.Base(fileName))
+		if _, err := tasks.SendFileRequest(fileName, agentName, schedule.DestinationAgent, destinationFileName, schedule.Priority, sourceAction); err != nil {
+			log.Error(fmt.Sprintf("Cannot send %s", fileName), err)
+			failed = append(failed, fmt.Sprintf("%s: %v", fileName, err))
+			continue
+		}
+		run.Files = append(run.Files, fileName)
+	}
+
+	if len(failed) > 0 {
+		run.Status = constant.ScheduleRunFailed
+		run.Error = errors.New(strings.Join(failed, "; ")).Error()
+		return
+	}
+	run.Status = constant.ScheduleRunSent
+	log.Info(fmt.Sprintf("Scheduled run sent %d files to %s", len(run.Files), schedule.DestinationAgent))
+}
@@ -9,7 +9,10 @@ import (
 	"github.com/willhackett/azure-mft/pkg/messaging"
 )
 
-func SendFileRequest(sourceFileName string, sourceAgent string, destinationAgent string, destinationFileName string) error {
+// SendFileRequest asks sourceAgent to send a file to destinationAgent and
+// returns the ID of the transfer. sourceAction, when not nil, is done with
+// the file once its delivery is confirmed if sourceAgent is this agent.
+func SendFileRequest(sourceFileName string, sourceAgent string, destinationAgent string, destinationFileName string, priority string, sourceAction *constant.SourceAction) (string, error) {
 	var payload []byte
 	var err error
 	uuid, _ := constant.GetUUID()
@@ -20,30 +23,32 @@ func SendFileRequest(sourceFileName string, sourceAgent string, destinationAgent
 		"sourceAgent":         sourceAgent,
 		"destinationAgent":    destinationAgent,
 		"destinationFileName": destinationFileName,
+		"priority":            priority,
 	})
 
 	details := constant.FileRequestMessage{
 		FileName:            sourceFileName,
 		DestinationAgent:    destinationAgent,
 		DestinationFileName: destinationFileName,
+		SourceAction:        sourceAction,
 	}
 
 	if payload, err = json.Marshal(details); err != nil {
 		log.Trace(err)
-		return err
+		return "", err
 	}
 
-	if err = messaging.SendMessage(uuid, constant.FileRequestMessageType, payload, sourceAgent); err != nil {
+	if err = messaging.SendMessage(uuid, constant.FileRequestMessageType, payload, sourceAgent, priority); err != nil {
 		log.Trace(err)
-		return err
+		return "", err
 	}
 
 	log.Info("Successfully sent file request")
 
-	return nil
+	return uuid, nil
 }
 
-func SendFileHandshake(id string, fileName string, fileSize int64, destinationAgent string) error {
+func SendFileHandshake(id string, fileName string, fileSize int64, destinationAgent string, priority string) error {
 	var payload []byte
 	var err error
 	log := logger.Get().WithFields(logrus.Fields{
@@ -62,7 +67,7 @@ func SendFileHandshake(id string, fileName string, fileSize int64, destinationAg
 		return err
 	}
 
-	if err = messaging.SendMessage(id, constant.FileHandshakeMessageType, payload, destinationAgent); err != nil {
+	if err = messaging.SendMessage(id, constant.FileHandshakeMessageType, payload, destinationAgent, priority); err != nil {
 		log.Error("Failed to send file handshake", err)
 		log.Trace(err)
 		return err
@@ -73,7 +78,7 @@ func SendFileHandshake(id string, fileName string, fileSize int64, destinationAg
 	return nil
 }
 
-func SendFileHandshakeResponse(id string, accepted bool, destinationAgent string, reason string) error {
+func SendFileHandshakeResponse(id string, accepted bool, destinationAgent string, reason string, priority string) error {
 	var payload []byte
 	var err error
 	log := logger.Get().WithFields(logrus.Fields{
@@ -91,7 +96,7 @@ func SendFileHandshakeResponse(id string, accepted bool, destinationAgent string
 		return err
 	}
 
-	if err = messaging.SendMessage(id, constant.FileHandshakeResponseMessageType, payload, destinationAgent); err != nil {
+	if err = messaging.SendMessage(id, constant.FileHandshakeResponseMessageType, payload, destinationAgent, priority); err != nil {
 		log.Error("Failed to send file handshake response", err)
 		return err
 	}
@@ -101,7 +106,7 @@ func SendFileHandshakeResponse(id string, accepted bool, destinationAgent string
 	return nil
 }
 
-func SendFileAvailable(id string, signedURL string, fileName string, destinationAgent string) error {
+func SendFileAvailable(id string, signedURL string, fileName string, destinationAgent string, receiptRequested bool, priority string) error {
 	var payload []byte
 	var err error
 	log := logger.Get().WithFields(logrus.Fields{
@@ -112,14 +117,15 @@ func SendFileAvailable(id string, signedURL string, fileName string, destination
 	})
 
 	if payload, err = json.Marshal(constant.FileAvailableMessage{
-		SignedURL: signedURL,
-		FileName:  fileName,
+		SignedURL:        signedURL,
+		FileName:         fileName,
+		ReceiptRequested: receiptRequested,
 	}); err != nil {
 		log.Trace(err)
 		return err
 	}
 
-	if err = messaging.SendMessage(id, constant.FileAvailableMessageType, payload, destinationAgent); err != nil {
+	if err = messaging.SendMessage(id, constant.FileAvailableMessageType, payload, destinationAgent, priority); err != nil {
 		log.Error("Failed to send file available", err)
 		return err
 	}
@@ -128,3 +134,32 @@ func SendFileAvailable(id string, signedURL string, fileName string, destination
 
 	return nil
 }
+
+func SendFileReceipt(id string, fileName string, fileSize int64, destinationAgent string, priority string) error {
+	var payload []byte
+	var err error
+	log := logger.Get().WithFields(logrus.Fields{
+		"id":               id,
+		"event":            "SendFileReceipt",
+		"destinationAgent": destinationAgent,
+		"fileName":         fileName,
+		"fileSize":         fileSize,
+	})
+
+	if payload, err = json.Marshal(constant.FileReceiptMessage{
+		FileName: fileName,
+		FileSize: fileSize,
+	}); err != nil {
+		log.Trace(err)
+		return err
+	}
+
+	if err = messaging.SendMessage(id, constant.FileReceiptMessageType, payload, destinationAgent, priority); err != nil {
+		log.Error("Failed to send file receipt", err)
+		return err
+	}
+
+	log.Info("Successfully sent file receipt")
+
+	return nil
+}
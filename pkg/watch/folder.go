@@ -0,0 +1,228 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/tasks"
+)
+
+// candidate is a dropped file waiting to be complete
+type candidate struct {
+	stamp
+
+	// since is when the file was last seen to change
+	since time.Time
+
+	// notBefore delays sending again after a failed request
+	notBefore time.Time
+}
+
+// folder sends the files dropped in the directory of a watch
+type folder struct {
+	conf       config.WatchConf
+	log        *logrus.Entry
+	candidates map[string]*candidate
+	sent       map[string]stamp
+}
+
+func newFolder(conf config.WatchConf) *folder {
+	return &folder{
+		conf:       conf,
+		log:        log.WithField("watch", conf.Name),
+		candidates: map[string]*candidate{},
+		sent:       loadSent(conf.Name),
+	}
+}
+
+// isMarker reports whether fileName is the marker of another file
+func (f *folder) isMarker(fileName string) bool {
+	return f.conf.Marker != "" && strings.HasSuffix(fileName, f.conf.Marker)
+}
+
+// matches reports whether a file is to be sent according to the include and
+// exclude patterns, which are matched against its base name. Files renamed
+// once sent are never sent again.
+func (f *folder) matches(fileName string) bool {
+	base := filepath.Base(fileName)
+	if f.conf.SourceAction == constant.SourceActionRename && strings.HasSuffix(base, f.conf.RenameSuffix) {
+		return false
+	}
+
+	included := len(f.conf.Include) == 0
+	for _, pattern := range f.conf.Include {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range f.conf.Exclude {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// consider makes a file a candidate to send unless it has been sent already.
+// A marker makes the file it marks a candidate.
+func (f *folder) consider(fileName string, now time.Time) {
+	if f.isMarker(fileName) {
+		fileName = strings.TrimSuffix(fileName, f.conf.Marker)
+	}
+	if _, ok := f.candidates[fileName]; ok || !f.matches(fileName) {
+		return
+	}
+
+	info, err := os.Stat(fileName)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	if sent, ok := f.sent[fileName]; ok && sent == stampOf(info) {
+		return
+	}
+
+	f.candidates[fileName] = &candidate{stamp: stampOf(info), since: now}
+}
+
+// rescan considers every file in the directory, picking up files dropped
+// while the daemon was stopped or whose events were missed, and forgets sent
+// files that are gone
+func (f *folder) rescan(now time.Time) {
+	entries, err := ioutil.ReadDir(f.conf.Directory)
+	if err != nil {
+		f.log.Error("Cannot read watched directory", err)
+		return
+	}
+	present := map[string]bool{}
+	for _, entry := range entries {
+		fileName := filepath.Join(f.conf.Directory, entry.Name())
+		present[fileName] = true
+		f.consider(fileName, now)
+	}
+
+	pruned := false
+	for fileName := range f.sent {
+		if !present[fileName] {
+			delete(f.sent, fileName)
+			pruned = true
+		}
+	}
+	if pruned {
+		saveSent(f.conf.Name, f.sent)
+	}
+}
+
+// ready reports whether a candidate is complete
+func (f *folder) ready(fileName string, c *candidate, now time.Time) bool {
+	if f.conf.Marker != "" {
+		_, err := os.Stat(fileName + f.conf.Marker)
+		return err == nil
+	}
+	return now.Sub(c.since) >= f.conf.StableFor
+}
+
+// check sends the candidates that are complete
+func (f *folder) check(now time.Time) {
+	for fileName, c := range f.candidates {
+		info, err := os.Stat(fileName)
+		if err != nil || !info.Mode().IsRegular() {
+			delete(f.candidates, fileName)
+			continue
+		}
+		if current := stampOf(info); current != c.stamp {
+			c.stamp = current
+			c.since = now
+			continue
+		}
+		if now.Before(c.notBefore) || !f.ready(fileName, c, now) {
+			continue
+		}
+
+		if err := f.send(fileName); err != nil {
+			f.log.Error(fmt.Sprintf("Cannot send %s, retrying in %s", fileName, constant.WatchRescanInterval), err)
+			c.notBefore = now.Add(constant.WatchRescanInterval)
+			continue
+		}
+
+		delete(f.candidates, fileName)
+		f.sent[fileName] = c.stamp
+		saveSent(f.conf.Name, f.sent)
+	}
+}
+
+// send requests the transfer of a complete file through this agent
+func (f *folder) send(fileName string) error {
+	sourceAction := constant.NewSourceAction(f.conf.SourceAction, f.conf.MoveTo, f.conf.RenameSuffix)
+	destinationFileName := path.Join(f.conf.DestinationPath, filepath.Base(fileName))
+	transferID, err := tasks.SendFileRequest(fileName, config.GetConfig().Agent.Name, f.conf.DestinationAgent, destinationFileName, f.conf.Priority, sourceAction)
+	if err != nil {
+		return err
+	}
+	f.log.WithField("id", transferID).Info(fmt.Sprintf("Sending dropped file %s to %s", fileName, f.conf.DestinationAgent))
+
+	// The marker has done its job once the file is on its way
+	if f.conf.Marker != "" {
+		if err := os.Remove(fileName + f.conf.Marker); err != nil && !os.IsNotExist(err) {
+			f.log.Warn(fmt.Sprintf("Cannot remove marker of %s", fileName), err)
+		}
+	}
+	return nil
+}
+
+// run watches the directory until ctx is done
+func (f *folder) run(ctx context.Context) error {
+	if err := os.MkdirAll(f.conf.Directory, 0755); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(f.conf.Directory); err != nil {
+		return err
+	}
+	f.log.Info(fmt.Sprintf("Watching %s for files to send to %s", f.conf.Directory, f.conf.DestinationAgent))
+
+	f.rescan(time.Now())
+
+	check := time.NewTicker(constant.WatchCheckInterval)
+	defer check.Stop()
+	rescan := time.NewTicker(constant.WatchRescanInterval)
+	defer rescan.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-watcher.Events:
+			if event.Op&fsnotify.Remove == 0 {
+				f.consider(event.Name, time.Now())
+			}
+		case err := <-watcher.Errors:
+			// Events may have been dropped, the directory is read again
+			f.log.Warn("Watch error, rescanning directory", err)
+			f.rescan(time.Now())
+		case <-check.C:
+			f.check(time.Now())
+		case <-rescan.C:
+			f.rescan(time.Now())
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+)
+
+func testFolder(conf config.WatchConf) *folder {
+	return &folder{
+		conf:       conf,
+		log:        log.WithField("watch", conf.Name),
+		candidates: map[string]*candidate{},
+		sent:       map[string]stamp{},
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     config.WatchConf
+		fileName string
+		want     bool
+	}{
+		{"everything without patterns", config.WatchConf{}, "/drop/file.csv", true},
+		{"included", config.WatchConf{Include: []string{"*.csv"}}, "/drop/file.csv", true},
+		{"not included", config.WatchConf{Include: []string{"*.csv"}}, "/drop/file.txt", false},
+		{"any include pattern", config.WatchConf{Include: []string{"*.txt", "*.csv"}}, "/drop/file.csv", true},
+		{"patterns match the base name", config.WatchConf{Include: []string{"drop*"}}, "/drop/file.csv", false},
+		{"excluded", config.WatchConf{Exclude: []string{"*.tmp"}}, "/drop/file.tmp", false},
+		{"exclude wins over include", config.WatchConf{Include: []string{"file.*"}, Exclude: []string{"*.tmp"}}, "/drop/file.tmp", false},
+		{"renamed once sent", config.WatchConf{SourceAction: constant.SourceActionRename, RenameSuffix: ".sent"}, "/drop/file.csv.sent", false},
+		{"suffix without renaming", config.WatchConf{SourceAction: constant.SourceActionKeep, RenameSuffix: ".sent"}, "/drop/file.csv.sent", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := testFolder(test.conf).matches(test.fileName); got != test.want {
+				t.Errorf("matches(%q) = %v, want %v", test.fileName, got, test.want)
+			}
+		})
+	}
+}
+
+func TestConsider(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string) string {
+		fileName := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fileName, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+
+	file := write("file.csv")
+	write("marked.csv")
+	marker := write("marked.csv.done")
+	sent := write("sent.csv")
+	changed := write("changed.csv")
+	subdirectory := filepath.Join(dir, "sub.csv")
+	if err := os.Mkdir(subdirectory, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	sentStamp := func(fileName string) stamp {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stampOf(info)
+	}
+
+	tests := []struct {
+		name     string
+		conf     config.WatchConf
+		sent     map[string]stamp
+		fileName string
+		want     string
+	}{
+		{"regular file", config.WatchConf{}, nil, file, file},
+		{"marker makes the file it marks a candidate", config.WatchConf{Marker: ".done"}, nil, marker, filepath.Join(dir, "marked.csv")},
+		{"not matching", config.WatchConf{Include: []string{"*.txt"}}, nil, file, ""},
+		{"missing file", config.WatchConf{}, nil, filepath.Join(dir, "missing.csv"), ""},
+		{"directory", config.WatchConf{}, nil, subdirectory, ""},
+		{"already sent", config.WatchConf{}, map[string]stamp{sent: sentStamp(sent)}, sent, ""},
+		{"changed since sent", config.WatchConf{}, map[string]stamp{changed: {}}, changed, changed},
+	}
+
+	now := time.Now()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := testFolder(test.conf)
+			if test.sent != nil {
+				f.sent = test.sent
+			}
+
+			f.consider(test.fileName, now)
+
+			if test.want == "" {
+				if len(f.candidates) != 0 {
+					t.Errorf("consider(%q) added candidates %v, want none", test.fileName, f.candidates)
+				}
+				return
+			}
+			c, ok := f.candidates[test.want]
+			if !ok || len(f.candidates) != 1 {
+				t.Fatalf("consider(%q) added candidates %v, want %s", test.fileName, f.candidates, test.want)
+			}
+			if c.stamp != sentStamp(test.want) || !c.since.Equal(now) {
+				t.Errorf("candidate %s = %+v, want stamp of the file seen at %s", test.want, c, now)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package watch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/willhackett/azure-mft/pkg/config"
+)
+
+const indexFileName = "watches.json"
+
+// stamp identifies a version of a file
+type stamp struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mod_time"`
+}
+
+func stampOf(info os.FileInfo) stamp {
+	return stamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+}
+
+// The index holds, for each watch, the files already sent and the version
+// sent, so that files kept in place are not sent again after a restart
+var indexLock sync.Mutex
+
+func indexFile() string {
+	return filepath.Join(config.GetConfig().Paths.CacheDir, indexFileName)
+}
+
+func loadIndex() map[string]map[string]stamp {
+	index := map[string]map[string]stamp{}
+
+	indexBytes, err := ioutil.ReadFile(indexFile())
+	if err == nil {
+		if err := json.Unmarshal(indexBytes, &index); err != nil {
+			log.Warn("Watch index is unreadable and has been reset", err)
+		}
+	}
+	return index
+}
+
+// loadSent returns the files a watch has sent
+func loadSent(name string) map[string]stamp {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+
+	if sent, ok := loadIndex()[name]; ok {
+		return sent
+	}
+	return map[string]stamp{}
+}
+
+// saveSent records the files a watch has sent
+func saveSent(name string, sent map[string]stamp) {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+
+	index := loadIndex()
+	index[name] = sent
+
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		log.Error("Cannot encode watch index", err)
+		return
+	}
+	if err := os.MkdirAll(config.GetConfig().Paths.CacheDir, 0700); err != nil {
+		log.Error("Cannot create watch index directory", err)
+		return
+	}
+	if err := ioutil.WriteFile(indexFile(), indexBytes, 0600); err != nil {
+		log.Error("Cannot save watch index", err)
+	}
+}
@@ -0,0 +1,76 @@
+package watch
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/willhackett/azure-mft/pkg/config"
+	"github.com/willhackett/azure-mft/pkg/constant"
+	"github.com/willhackett/azure-mft/pkg/logger"
+)
+
+var log = logger.Get().WithFields(logrus.Fields{
+	"event": "Watch",
+})
+
+// watchFolder runs a watch until ctx is done, starting it again after a
+// delay if it fails
+func watchFolder(ctx context.Context, conf config.WatchConf) {
+	for {
+		err := newFolder(conf).run(ctx)
+		if err == nil {
+			return
+		}
+		log.WithField("watch", conf.Name).Error("Cannot watch directory "+conf.Directory, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(constant.WatchRescanInterval):
+		}
+	}
+}
+
+// Run runs the configured watches until ctx is done. Watches are restarted
+// when a configuration reload changes them.
+func Run(ctx context.Context) {
+	changed := make(chan struct{}, 1)
+	config.OnChange(func(cfg config.Config) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	for {
+		watches := config.GetConfig().Watches
+		watchContext, cancel := context.WithCancel(ctx)
+		running := sync.WaitGroup{}
+
+		for _, conf := range watches {
+			running.Add(1)
+			go func(conf config.WatchConf) {
+				defer running.Done()
+				watchFolder(watchContext, conf)
+			}(conf)
+		}
+
+		for unchanged := true; unchanged; {
+			select {
+			case <-ctx.Done():
+				cancel()
+				running.Wait()
+				return
+			case <-changed:
+				unchanged = reflect.DeepEqual(watches, config.GetConfig().Watches)
+			}
+		}
+
+		log.Info("Restarting watches with the reloaded configuration")
+		cancel()
+		running.Wait()
+	}
+}